@@ -81,12 +81,69 @@ func (m *ConfigMap) TryAdd(pod, container string) string {
 	return container
 }
 
+// Match returns the value for the most specific key matching name. Keys with more literal characters
+// are more specific, ties are broken by the number of wildcards and then in lexical order.
 func (m ConfigMap) Match(name string) (string, bool) {
-	for k, v := range m {
-		if ok, _ := path.Match(k, name); ok {
-			return v, true
+	best := ""
+	found := false
+
+	for k := range m {
+		if ok, _ := path.Match(k, name); !ok {
+			continue
+		}
+		if found && !moreSpecific(k, best) {
+			continue
+		}
+		best = k
+		found = true
+	}
+	if !found {
+		return "", false
+	}
+
+	return m[best], true
+}
+
+func moreSpecific(pattern, other string) bool {
+	literals, wildcards := patternSpecificity(pattern)
+	otherLiterals, otherWildcards := patternSpecificity(other)
+
+	if literals != otherLiterals {
+		return literals > otherLiterals
+	}
+	if wildcards != otherWildcards {
+		return wildcards < otherWildcards
+	}
+
+	return pattern < other
+}
+
+func patternSpecificity(pattern string) (literals, wildcards int) {
+	inClass := false
+	escaped := false
+
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+			if !inClass {
+				literals++
+			}
+		case r == '\\':
+			escaped = true
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+		case r == '[':
+			inClass = true
+			wildcards++
+		case r == '*' || r == '?':
+			wildcards++
+		default:
+			literals++
 		}
 	}
 
-	return "", false
+	return literals, wildcards
 }
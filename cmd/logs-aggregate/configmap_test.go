@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConfigMapMatch(t *testing.T) {
+	m := ConfigMap{
+		"deploy/*":     "app",
+		"deploy/api":   "api",
+		"deploy/api-*": "api-sidecar",
+		"deploy/a?i":   "question",
+		"deploy/[ab]*": "class",
+		"sts/db-0":     "db",
+		"sts/db-*":     "db-any",
+		"job/x*":       "x-star",
+		"job/*x":       "star-x",
+	}
+
+	tests := []struct {
+		name      string
+		want      string
+		wantFound bool
+	}{
+		{name: "deploy/api", want: "api", wantFound: true},
+		{name: "deploy/api-v2", want: "api-sidecar", wantFound: true},
+		{name: "deploy/aqi", want: "question", wantFound: true},
+		// same number of literals, the pattern with fewer wildcards wins
+		{name: "deploy/batch", want: "app", wantFound: true},
+		{name: "deploy/web", want: "app", wantFound: true},
+		{name: "sts/db-0", want: "db", wantFound: true},
+		{name: "sts/db-10", want: "db-any", wantFound: true},
+		// same number of literals and wildcards, the lexically first pattern wins
+		{name: "job/xx", want: "star-x", wantFound: true},
+		{name: "ds/agent"},
+	}
+
+	// the map is iterated in a random order, the match must not depend on it
+	for i := 0; i < 20; i++ {
+		for _, test := range tests {
+			got, found := m.Match(test.name)
+			if got != test.want || found != test.wantFound {
+				t.Fatalf("Match(%q) = %q, %t, want %q, %t", test.name, got, found, test.want, test.wantFound)
+			}
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ExecKillTimeout is how long the commands have to exit once terminated before being killed.
+	ExecKillTimeout = 2 * time.Second
+	// ExecStableRun is how long a command has to run for its restart backoff to be reset.
+	ExecStableRun = 10 * time.Second
+
+	errExecStopped = errors.New("command stopped")
+
+	commands = &commandSet{
+		sources: map[*execSource]bool{},
+	}
+)
+
+// ExecStreams starts command with the shell, returning a stream for its stdout and one for its stderr. The
+// lines that are not JSON objects are wrapped by streamLogs, once multi-line events are joined. The command is
+// restarted with a backoff when it exits if restart is set.
+func ExecStreams(command string, restart bool) ([]Stream, error) {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	s := &execSource{
+		command: command,
+		restart: restart,
+
+		stdout: stdoutW,
+		stderr: stderrW,
+
+		done: make(chan struct{}),
+		m:    &sync.Mutex{},
+	}
+
+	cmd, err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	commands.add(s)
+	go s.run(cmd)
+
+	return []Stream{
+		{
+			ReadCloser: stdoutR,
+			Fields: map[string]interface{}{
+				"_source":  "exec",
+				"_command": command,
+				"_stream":  "stdout",
+			},
+			Wrap: true,
+		},
+		{
+			ReadCloser: stderrR,
+			Fields: map[string]interface{}{
+				"_source":  "exec",
+				"_command": command,
+				"_stream":  "stderr",
+			},
+			Wrap: true,
+		},
+	}, nil
+}
+
+// StopCommands terminates the commands started by ExecStreams, killing them if they do not exit in time.
+func StopCommands() {
+	commands.stop()
+}
+
+type commandSet struct {
+	sources map[*execSource]bool
+	m       sync.Mutex
+}
+
+func (c *commandSet) add(s *execSource) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.sources[s] = true
+}
+
+func (c *commandSet) remove(s *execSource) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	delete(c.sources, s)
+}
+
+func (c *commandSet) stop() {
+	c.m.Lock()
+	sources := make([]*execSource, 0, len(c.sources))
+	for s := range c.sources {
+		sources = append(sources, s)
+	}
+	c.m.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, s := range sources {
+		s := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.stop()
+		}()
+	}
+	wg.Wait()
+}
+
+type execSource struct {
+	command string
+	restart bool
+
+	stdout *io.PipeWriter
+	stderr *io.PipeWriter
+
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	stopped bool
+	done    chan struct{}
+	m       *sync.Mutex
+}
+
+func (s *execSource) start() (*exec.Cmd, error) {
+	stdout, stderr := newLineWriter(s.stdout), newLineWriter(s.stderr)
+	cmd := shellCommand(s.command)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := errExecStopped
+	if !s.stopped {
+		err = cmd.Start()
+	}
+	if err != nil {
+		_ = stdout.Close()
+		_ = stderr.Close()
+		return nil, err
+	}
+	s.cmd = cmd
+	s.exited = make(chan struct{})
+
+	return cmd, nil
+}
+
+func (s *execSource) run(cmd *exec.Cmd) {
+	defer commands.remove(s)
+	attempt := 0
+
+	for {
+		started := time.Now()
+		err := s.wait(cmd)
+
+		fields := map[string]interface{}{}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+
+		select {
+		case <-s.done:
+			s.detach()
+			return
+		default:
+		}
+		if !s.restart {
+			s.trace("command exited", fields)
+			s.detach()
+			return
+		}
+
+		if time.Since(started) > ExecStableRun {
+			attempt = 0
+		}
+		attempt++
+		backoff := reconnectBackoff(attempt)
+		fields["attempt"] = attempt
+		fields["backoff"] = backoff.String()
+		s.trace("command exited, restarting", fields)
+		metrics.Inc(metricReconnects, metrics.Labels(map[string]interface{}{
+			"_source":  "exec",
+			"_command": s.command,
+		}))
+
+		select {
+		case <-s.done:
+			s.detach()
+			return
+		case <-time.After(backoff):
+		}
+
+		cmd, err = s.start()
+		for err != nil {
+			if err == errExecStopped {
+				s.detach()
+				return
+			}
+
+			attempt++
+			backoff = reconnectBackoff(attempt)
+			s.trace("starting command", map[string]interface{}{
+				"error":   err.Error(),
+				"attempt": attempt,
+				"backoff": backoff.String(),
+			})
+
+			select {
+			case <-s.done:
+				s.detach()
+				return
+			case <-time.After(backoff):
+			}
+			cmd, err = s.start()
+		}
+	}
+}
+
+func (s *execSource) wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+
+	s.m.Lock()
+	close(s.exited)
+	s.m.Unlock()
+
+	_ = cmd.Stdout.(*lineWriter).Close()
+	_ = cmd.Stderr.(*lineWriter).Close()
+
+	return err
+}
+
+// stop terminates the command and waits for it to exit, killing it after ExecKillTimeout.
+func (s *execSource) stop() {
+	s.m.Lock()
+	if s.stopped {
+		s.m.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.done)
+	cmd, exited := s.cmd, s.exited
+	s.m.Unlock()
+
+	if cmd == nil {
+		return
+	}
+
+	_ = terminate(cmd, false)
+	select {
+	case <-exited:
+	case <-time.After(ExecKillTimeout):
+		_ = terminate(cmd, true)
+	}
+}
+
+func (s *execSource) detach() {
+	_ = s.stdout.CloseWithError(errStreamDetached)
+	_ = s.stderr.CloseWithError(errStreamDetached)
+}
+
+func (s *execSource) trace(msg string, fields map[string]interface{}) {
+	fields["time"] = time.Now()
+	fields["level"] = "trace"
+	fields["msg"] = msg
+	fields["command"] = s.command
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	_, _ = s.stderr.Write(append(b, '\n'))
+}
+
+// lineWriter writes the lines written to it to w, a line at a time so that they are not interleaved with the
+// traces. A last line without a newline is terminated when closing.
+// Once w is closed the lines are discarded, so that the command never blocks on its output.
+type lineWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func newLineWriter(w io.Writer) *lineWriter {
+	r, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		failed := false
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" && !failed {
+				if !strings.HasSuffix(line, "\n") {
+					line += "\n"
+				}
+				_, werr := io.WriteString(w, line)
+				failed = werr != nil
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return &lineWriter{
+		pw:   pw,
+		done: done,
+	}
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	return lw.pw.Write(p)
+}
+
+// Close waits for the lines written so far to be written to the underlying writer.
+func (lw *lineWriter) Close() error {
+	err := lw.pw.Close()
+	<-lw.done
+
+	return err
+}
+
+// wrapLine wraps a line that is not a JSON object in an entry with the line as the message.
+func wrapLine(line string, now time.Time) string {
+	if strings.HasPrefix(line, "{") && json.Valid([]byte(line)) {
+		return line
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"time": now,
+		"msg":  line,
+	})
+	if err != nil {
+		return line
+	}
+
+	return string(b)
+}
@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestExecStreams(t *testing.T) {
+	streams, err := ExecStreams(`printf 'panic: boom\n\ngoroutine 1 [running]:\n{"msg":"json"}\nlast'; echo error >&2`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stream := range streams {
+		if !stream.Wrap {
+			t.Errorf("%v stream not wrapped", stream.Fields["_stream"])
+		}
+	}
+
+	stderr := make(chan string, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(streams[1])
+		stderr <- string(b)
+	}()
+
+	// the lines are left raw, to be joined and wrapped once by streamLogs
+	stdout, err := ioutil.ReadAll(streams[0])
+	if err != errStreamDetached {
+		t.Errorf("stdout ended with %v, want %v", err, errStreamDetached)
+	}
+	if want := "panic: boom\n\ngoroutine 1 [running]:\n{\"msg\":\"json\"}\nlast\n"; string(stdout) != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+
+	lines := strings.Split(strings.TrimSpace(<-stderr), "\n")
+	if len(lines) != 2 || lines[0] != "error" || !strings.Contains(lines[1], `"msg":"command exited"`) {
+		t.Errorf("stderr = %q, want the line and the exit trace", lines)
+	}
+}
+
+func TestWrapLine(t *testing.T) {
+	now := testEpoch
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"msg":"a"}`, `{"msg":"a"}`},
+		{`{"msg":`, `{"msg":"{\"msg\":","time":"2024-01-01T12:00:00Z"}`},
+		{"plain text", `{"msg":"plain text","time":"2024-01-01T12:00:00Z"}`},
+	}
+
+	for _, test := range tests {
+		if got := wrapLine(test.line, now); got != test.want {
+			t.Errorf("wrapLine(%q) = %s, want %s", test.line, got, test.want)
+		}
+	}
+}
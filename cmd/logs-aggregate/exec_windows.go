@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os/exec"
+)
+
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// terminate kills the command, since there are no signals to ask it to exit on windows.
+func terminate(cmd *exec.Cmd, _ bool) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	FilePollInterval = 250 * time.Millisecond
+
+	errFileRead = errors.New("file already read")
+)
+
+// FileStreams sends a stream for each file matching the glob patterns. The files are read from the last -tail
+// lines, or from the start when -tail is not set, unless following in which case they are read from the end.
+// When following, the patterns are matched again periodically: new files are read from the start, and every
+// file is followed through truncation and rotation, like `tail -F`.
+func FileStreams(conf Config, streams chan<- Stream, stop <-chan struct{}) error {
+	for _, pattern := range conf.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %v", pattern, err)
+		}
+	}
+
+	tailed := map[string]bool{}
+	files := &fileSet{
+		m: &sync.Mutex{},
+	}
+	initial := true
+	for {
+		paths, err := globFiles(conf.Files)
+		if err != nil {
+			return err
+		}
+		if initial && !conf.Follow && len(paths) == 0 {
+			return fmt.Errorf("no files matching %s", strings.Join(conf.Files, ", "))
+		}
+
+		for _, path := range paths {
+			if tailed[path] {
+				continue
+			}
+			tailed[path] = true
+
+			tail, fromEnd := conf.Tail, conf.Follow
+			if !initial {
+				tail, fromEnd = -1, false
+			}
+			stream, err := newFileStream(path, tail, fromEnd, conf.Follow, files)
+			if err == errFileRead {
+				continue
+			}
+			if err != nil && initial {
+				return err
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				continue
+			}
+
+			streams <- Stream{
+				ReadCloser: stream,
+				Fields: map[string]interface{}{
+					"_source": "file",
+					"_file":   path,
+				},
+			}
+		}
+
+		if !conf.Follow {
+			return nil
+		}
+		initial = false
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(FilePollInterval):
+		}
+	}
+}
+
+// fileSet holds the files being read or already read, by identity (device and inode on Unix) rather than by
+// path, so that rotated files are not read again when their new name matches the patterns (i.e. app.log.1).
+type fileSet struct {
+	files []os.FileInfo
+	m     *sync.Mutex
+}
+
+// add adds a file to the set, returning false if it is already in the set.
+func (s *fileSet) add(f *os.File) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, known := range s.files {
+		if os.SameFile(known, fi) {
+			return false, nil
+		}
+	}
+	s.files = append(s.files, fi)
+
+	return true, nil
+}
+
+func globFiles(patterns []string) ([]string, error) {
+	paths := []string{}
+	seen := map[string]bool{}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file pattern %q: %v", pattern, err)
+		}
+		sort.Strings(matches)
+
+		for _, path := range matches {
+			if seen[path] {
+				continue
+			}
+			fi, err := os.Stat(path)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
+}
+
+// fileStream reads the lines of a file. When following, it waits for new lines at the end of the file, starts
+// over when the file is truncated and switches to the new file when it is replaced (rotated), after reading the
+// rest of the old one. The stream ends with errStreamDetached once it is closed.
+type fileStream struct {
+	path   string
+	follow bool
+	files  *fileSet
+
+	f       *os.File
+	offset  int64
+	partial []byte
+
+	r    *io.PipeReader
+	w    *io.PipeWriter
+	done chan struct{}
+	once *sync.Once
+}
+
+// newFileStream returns a stream for the file at path, or errFileRead if the file was already read under
+// another path.
+func newFileStream(path string, tail int64, fromEnd, follow bool, files *fileSet) (*fileStream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	added, err := files.add(f)
+	if err == nil && !added {
+		_ = f.Close()
+		return nil, errFileRead
+	}
+
+	var offset int64
+	if err == nil {
+		offset, err = startOffset(f, tail, fromEnd)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("reading %q: %v", path, err)
+	}
+
+	r, w := io.Pipe()
+	s := &fileStream{
+		path:   path,
+		follow: follow,
+		files:  files,
+
+		f:      f,
+		offset: offset,
+
+		r:    r,
+		w:    w,
+		done: make(chan struct{}),
+		once: &sync.Once{},
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *fileStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *fileStream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+
+	return s.w.CloseWithError(errStreamDetached)
+}
+
+func (s *fileStream) run() {
+	defer func() {
+		_ = s.f.Close()
+	}()
+
+	for {
+		err := s.readAvailable()
+		if err != nil {
+			_ = s.w.CloseWithError(err)
+			return
+		}
+
+		if !s.follow {
+			_ = s.flushPartial()
+			_ = s.w.Close()
+			return
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(FilePollInterval):
+		}
+
+		err = s.checkFile()
+		if err != nil {
+			_ = s.w.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// readAvailable writes the complete lines available in the file, keeping the last line if it is not
+// terminated yet.
+func (s *fileStream) readAvailable() error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.f.Read(buf)
+		if n > 0 {
+			s.offset += int64(n)
+			werr := s.writeLines(buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %q: %v", s.path, err)
+		}
+	}
+}
+
+func (s *fileStream) writeLines(b []byte) error {
+	s.partial = append(s.partial, b...)
+
+	i := bytes.LastIndexByte(s.partial, '\n')
+	if i < 0 {
+		return nil
+	}
+
+	_, err := s.w.Write(s.partial[:i+1])
+	s.partial = append(s.partial[:0], s.partial[i+1:]...)
+
+	return err
+}
+
+func (s *fileStream) flushPartial() error {
+	if len(s.partial) == 0 {
+		return nil
+	}
+
+	_, err := s.w.Write(append(s.partial, '\n'))
+	s.partial = nil
+
+	return err
+}
+
+// checkFile looks for the file being truncated or replaced. A file that was removed is waited for, since
+// it may be recreated.
+func (s *fileStream) checkFile() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil
+	}
+	current, err := s.f.Stat()
+	if err != nil {
+		return fmt.Errorf("reading %q: %v", s.path, err)
+	}
+
+	if !os.SameFile(fi, current) {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return nil
+		}
+		_, _ = s.files.add(f)
+
+		err = s.readAvailable()
+		if err == nil {
+			err = s.flushPartial()
+		}
+		_ = s.f.Close()
+		s.f, s.offset = f, 0
+		if err != nil {
+			return err
+		}
+		s.trace("file rotated, following the new file")
+
+		return nil
+	}
+
+	if fi.Size() < s.offset {
+		_, err = s.f.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("reading %q: %v", s.path, err)
+		}
+		s.offset = 0
+		s.partial = nil
+		s.trace("file truncated, reading from the start")
+	}
+
+	return nil
+}
+
+func (s *fileStream) trace(msg string) {
+	b, err := json.Marshal(map[string]interface{}{
+		"time":  time.Now(),
+		"level": "trace",
+		"msg":   msg,
+		"file":  s.path,
+	})
+	if err != nil {
+		return
+	}
+	_, _ = s.w.Write(append(b, '\n'))
+}
+
+// startOffset returns the offset of the last tail lines of f, if tail is not negative. Otherwise the file
+// is read from its end or from its start.
+func startOffset(f *os.File, tail int64, fromEnd bool) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	switch {
+	case tail >= 0:
+		return tailOffset(f, size, tail)
+	case fromEnd:
+		return size, nil
+	default:
+		return 0, nil
+	}
+}
+
+func tailOffset(r io.ReaderAt, size, lines int64) (int64, error) {
+	if lines == 0 {
+		return size, nil
+	}
+
+	buf := make([]byte, 32*1024)
+	count := int64(0)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		_, err := r.ReadAt(chunk, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		for i := len(chunk) - 1; i >= 0; i-- {
+			pos := start + int64(i)
+			if chunk[i] != '\n' || pos == size-1 {
+				continue
+			}
+			count++
+			if count == lines {
+				return pos + 1, nil
+			}
+		}
+		end = start
+	}
+
+	return 0, nil
+}
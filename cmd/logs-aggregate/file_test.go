@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func appendFile(t *testing.T, path, s string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(s)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func init() {
+	// set once, the streams of the tests keep polling in the background
+	FilePollInterval = 10 * time.Millisecond
+}
+
+func TestFileStreamsRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs-aggregate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "old 1\n")
+
+	stop := make(chan struct{})
+	streams := make(chan Stream, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- FileStreams(Config{Files: []string{filepath.Join(dir, "app.log*")}, Follow: true, Tail: 0}, streams, stop)
+	}()
+
+	stream := receiveStream(t, streams)
+	if stream.Fields["_file"] != path {
+		t.Fatalf("stream of %v, want %q", stream.Fields["_file"], path)
+	}
+
+	lines := make(chan string, 10)
+	go func() {
+		r := bufio.NewReader(stream)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			if !strings.Contains(line, `"level":"trace"`) {
+				lines <- strings.TrimSpace(line)
+			}
+		}
+	}()
+
+	appendFile(t, path, "old 2\n")
+	time.Sleep(5 * FilePollInterval)
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "old 3\n")
+	appendFile(t, path, "new 1\n")
+
+	got := []string{}
+	for len(got) < 3 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %v", got)
+		}
+	}
+	if want := []string{"old 2", "old 3", "new 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+
+	select {
+	case stream := <-streams:
+		t.Errorf("unexpected stream of %v", stream.Fields["_file"])
+	case line := <-lines:
+		t.Errorf("unexpected line %q", line)
+	case <-time.After(20 * FilePollInterval):
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	_ = stream.Close()
+}
+
+func TestTailOffset(t *testing.T) {
+	tests := []struct {
+		content string
+		lines   int64
+		want    string
+	}{
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\nc\n", 5, "a\nb\nc\n"},
+		{"a\nb\nc\n", 0, ""},
+		{"", 3, ""},
+	}
+
+	for _, test := range tests {
+		r := strings.NewReader(test.content)
+		offset, err := tailOffset(r, int64(len(test.content)), test.lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := test.content[offset:]; got != test.want {
+			t.Errorf("last %d lines of %q = %q, want %q", test.lines, test.content, got, test.want)
+		}
+	}
+}
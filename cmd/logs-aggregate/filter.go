@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Pimmr/logs-dashboard/internal/filter"
+)
+
+// SourceFilter is a filter applied to the streams with a field matching a pattern.
+type SourceFilter struct {
+	Field   string
+	Pattern string
+	Query   string
+}
+
+// SourceFilters are parsed from 'field=pattern:query'. A ':' in the pattern must be escaped with '\'.
+type SourceFilters []SourceFilter
+
+func (f SourceFilters) String() string {
+	ss := make([]string, len(f))
+	for i, sf := range f {
+		ss[i] = fmt.Sprintf("%s=%s:%s", sf.Field, sf.Pattern, sf.Query)
+	}
+
+	return strings.Join(ss, "; ")
+}
+
+func (f *SourceFilters) Set(s string) error {
+	field, pattern, query, err := parseSourceSelector(s, "source filter", "query")
+	if err != nil {
+		return err
+	}
+
+	*f = append(*f, SourceFilter{
+		Field:   field,
+		Pattern: pattern,
+		Query:   query,
+	})
+
+	return nil
+}
+
+// parseSourceSelector splits 'field=pattern:value', checking the pattern.
+func parseSourceSelector(s, what, value string) (string, string, string, error) {
+	i := unescapedIndex(s, ':')
+	if i < 0 {
+		return "", "", "", fmt.Errorf("malformed %s %q, expected 'field=pattern:%s'", what, s, value)
+	}
+	selector, rest := s[:i], strings.TrimSpace(s[i+1:])
+
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", "", fmt.Errorf("malformed %s %q, expected 'field=pattern:%s'", what, s, value)
+	}
+	pattern := strings.TrimSpace(parts[1])
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", "", "", fmt.Errorf("invalid pattern in %s %q: %v", what, s, err)
+	}
+
+	return strings.TrimSpace(parts[0]), pattern, rest, nil
+}
+
+// matchSource reports whether the field of a stream matches the pattern.
+func matchSource(fields map[string]interface{}, field, pattern string) bool {
+	v, ok := fields[field]
+	if !ok {
+		return false
+	}
+	ok, _ = path.Match(pattern, fmt.Sprint(v))
+
+	return ok
+}
+
+func unescapedIndex(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+
+	return -1
+}
+
+// LineFilter filters the lines of the streams with the -filter query and the source filters matching each
+// stream. The queries are evaluated on the lines tagged with the fields of their stream, so that they can
+// use _source, _pod, etc. even without -tag.
+type LineFilter struct {
+	filter  *queryFilter
+	sources []sourceFilter
+	id      uint64
+}
+
+type sourceFilter struct {
+	SourceFilter
+	filter *queryFilter
+}
+
+// queryFilter is a filter that reports its errors once.
+type queryFilter struct {
+	*filter.Filter
+	// failed is set once an error of the filter is reported.
+	failed int32
+}
+
+func NewLineFilter(conf Config) (*LineFilter, error) {
+	lf := &LineFilter{}
+
+	if strings.TrimSpace(conf.Filter) != "" {
+		f, err := newFilter(conf.Filter, conf.MessageKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", conf.Filter, err)
+		}
+		lf.filter = f
+	}
+
+	for _, sf := range conf.SourceFilter {
+		f, err := newFilter(sf.Query, conf.MessageKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source filter %q: %v", sf.Query, err)
+		}
+		lf.sources = append(lf.sources, sourceFilter{
+			SourceFilter: sf,
+			filter:       f,
+		})
+	}
+
+	return lf, nil
+}
+
+func newFilter(query string, messageKeys []string) (*queryFilter, error) {
+	f := filter.New(messageKeys)
+	f.Set(query)
+
+	return &queryFilter{
+		Filter: f,
+	}, f.Validate()
+}
+
+// Stream returns the filters applying to a stream.
+func (lf *LineFilter) Stream(fields map[string]interface{}) []*queryFilter {
+	filters := []*queryFilter{}
+	if lf.filter != nil {
+		filters = append(filters, lf.filter)
+	}
+
+	for _, sf := range lf.sources {
+		if matchSource(fields, sf.Field, sf.Pattern) {
+			filters = append(filters, sf.filter)
+		}
+	}
+
+	return filters
+}
+
+// Match reports whether line matches all the filters. Lines that a filter fails to evaluate do not match; the
+// error is only returned the first time the filter fails, so that it is reported once.
+func (lf *LineFilter) Match(filters []*queryFilter, line string, fields map[string]interface{}) (bool, error) {
+	if len(filters) == 0 {
+		return true, nil
+	}
+
+	b := []byte(line)
+	tagged := []byte(tagLine(line, fields))
+	id := atomic.AddUint64(&lf.id, 1)
+
+	for _, f := range filters {
+		matched, err := f.ExecuteTagged(id, b, tagged)
+		if err != nil && atomic.CompareAndSwapInt32(&f.failed, 0, 1) {
+			return false, fmt.Errorf("filter %q: %v (lines failing the filter are dropped)", f.Query(), err)
+		}
+		if err != nil {
+			return false, nil
+		}
+		if matched == nil {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
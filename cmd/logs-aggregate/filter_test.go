@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLineFilterMatch(t *testing.T) {
+	lf, err := NewLineFilter(Config{
+		Filter:      "level = 'error'",
+		MessageKeys: []string{"msg"},
+		SourceFilter: SourceFilters{
+			{Field: "_pod", Pattern: "api-*", Query: "count + 1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fields  map[string]interface{}
+		line    string
+		want    bool
+		wantErr bool
+	}{
+		{map[string]interface{}{"_pod": "web-1"}, `{"level":"error","count":1}`, true, false},
+		{map[string]interface{}{"_pod": "web-1"}, `{"level":"info","count":1}`, false, false},
+		// the source filter cannot be evaluated, the error is only reported for the first line
+		{map[string]interface{}{"_pod": "api-1"}, `{"level":"error","count":1}`, false, true},
+		{map[string]interface{}{"_pod": "api-1"}, `{"level":"error","count":2}`, false, false},
+		{map[string]interface{}{"_pod": "api-2"}, `{"level":"error","count":3}`, false, false},
+	}
+
+	for _, test := range tests {
+		got, err := lf.Match(lf.Stream(test.fields), test.line, test.fields)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Match(%s) error = %v, want error: %t", test.line, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("Match(%s) = %t, want %t", test.line, got, test.want)
+		}
+	}
+}
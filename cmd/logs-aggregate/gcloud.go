@@ -2,15 +2,140 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"os"
-	"os/exec"
+	"io/ioutil"
+	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/Pimmr/logs-dashboard/internal/normalize"
+	"golang.org/x/oauth2/google"
+)
+
+var (
+	CloudLoggingTimeout = 30 * time.Second
+
+	// gcloudDefaultFreshness mirrors the default of `gcloud logging read`, so that the first poll does not go
+	// through the whole retention period.
+	gcloudDefaultFreshness = 24 * time.Hour
+
+	gcloudProjectPrefix = regexp.MustCompile(`^([a-z][a-z0-9-]{4,28}[a-z0-9])/`)
 )
 
-func gcloudStream(conf Config, filter string) io.ReadCloser {
+const (
+	cloudLoggingScope    = "https://www.googleapis.com/auth/logging.read"
+	cloudLoggingPageSize = 1000
+)
+
+type ListEntriesRequest struct {
+	ResourceNames []string `json:"resourceNames"`
+	Filter        string   `json:"filter,omitempty"`
+	OrderBy       string   `json:"orderBy,omitempty"`
+	PageSize      int      `json:"pageSize,omitempty"`
+	PageToken     string   `json:"pageToken,omitempty"`
+}
+
+type ListEntriesResponse struct {
+	Entries       []Entry `json:"entries"`
+	NextPageToken string  `json:"nextPageToken"`
+}
+
+// CloudLogging lists entries from the Cloud Logging API.
+type CloudLogging interface {
+	ListEntries(ctx context.Context, req ListEntriesRequest) (ListEntriesResponse, error)
+}
+
+type cloudLoggingClient struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewCloudLogging creates a client for the Cloud Logging REST API at endpoint, using the application default credentials.
+func NewCloudLogging(ctx context.Context, endpoint string) (CloudLogging, error) {
+	client, err := google.DefaultClient(ctx, cloudLoggingScope)
+	if err != nil {
+		return nil, fmt.Errorf("creating cloud logging client: %w", err)
+	}
+
+	return &cloudLoggingClient{
+		client:   client,
+		endpoint: strings.TrimRight(endpoint, "/"),
+	}, nil
+}
+
+func (c *cloudLoggingClient) ListEntries(ctx context.Context, req ListEntriesRequest) (ListEntriesResponse, error) {
+	var resp ListEntriesResponse
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, c.endpoint+"/v2/entries:list", bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return resp, cloudLoggingError(httpResp)
+	}
+
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return resp, fmt.Errorf("decoding cloud logging response: %w", err)
+	}
+
+	return resp, nil
+}
+
+func cloudLoggingError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var apiErr struct {
+		Error struct {
+			Message string
+			Status  string
+		}
+	}
+	err := json.Unmarshal(b, &apiErr)
+	if err != nil || apiErr.Error.Message == "" {
+		return fmt.Errorf("cloud logging: %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	return fmt.Errorf("cloud logging: %s (%s)", apiErr.Error.Message, apiErr.Error.Status)
+}
+
+// splitGcloudProject extracts the project from a filter in the form 'project/filter'.
+func splitGcloudProject(source, defaultProject string) (project, filter string) {
+	m := gcloudProjectPrefix.FindStringSubmatch(source)
+	if m == nil {
+		return defaultProject, source
+	}
+
+	return m[1], source[len(m[0]):]
+}
+
+func gcloudStream(conf Config, logging CloudLogging, source string) Stream {
+	project, filter := splitGcloudProject(source, conf.GcloudProject)
+	fields := map[string]interface{}{
+		"_source":  "gcloud",
+		"_filter":  filter,
+		"_project": project,
+	}
+	labels := metrics.Labels(fields)
 	r, w := io.Pipe()
 	enc := json.NewEncoder(w)
 
@@ -22,31 +147,53 @@ func gcloudStream(conf Config, filter string) io.ReadCloser {
 			interval = 0
 		}
 
-		knownInsertIDs := make(map[string]struct{}, 10000)
+		window := newDedupWindow()
 
 		for range Tick(interval) {
-			entries, err := gcloudStreamEntries(conf, lastTimestamp, filter)
+			var from time.Time
+			if !lastTimestamp.IsZero() {
+				from = lastTimestamp.Add(-conf.GcloudOverlap)
+			}
+
+			start := time.Now()
+			entries, err := gcloudStreamEntries(conf, logging, project, filter, from)
+			metrics.Observe(metricGcloudPoll, labels, time.Since(start).Seconds())
+			metrics.Add(metricGcloudPollEntries, labels, float64(len(entries)))
 			if err != nil {
-				_ = enc.Encode(json.RawMessage([]byte("Error: " + err.Error())))
-				return
+				metrics.Inc(metricGcloudPollErrors, labels)
+				_ = enc.Encode(gcloudErrorEntry("failed to list cloud logging entries", err, project, filter))
 			}
 
-			// entries is in reverse chronological order
-			for i := len(entries) - 1; i >= 0; i-- {
-				if _, ok := knownInsertIDs[entries[i].InsertID]; ok {
+			duplicates := 0
+			for i := range entries {
+				if window.Seen(entries[i].InsertID, entries[i].Timestamp) {
+					duplicates++
 					continue
 				}
-				knownInsertIDs[entries[i].InsertID] = struct{}{}
 
-				entry := entries[i].ToLogrus()
-				err := enc.Encode(entry)
+				err := enc.Encode(entries[i].ToLogrus())
 				if err != nil {
-					_ = enc.Encode(json.RawMessage([]byte("Error: failed to encode log")))
+					_ = enc.Encode(gcloudErrorEntry("failed to encode log", err, project, filter))
+				}
+				if entries[i].Timestamp.After(lastTimestamp) {
+					lastTimestamp = entries[i].Timestamp
 				}
 			}
-			if len(entries) != 0 {
-				lastTimestamp = entries[0].Timestamp
+			// the next poll only lists entries from lastTimestamp-overlap, older entries cannot be listed again
+			window.Forget(lastTimestamp.Add(-conf.GcloudOverlap))
+
+			if duplicates > 0 {
+				_ = enc.Encode(map[string]interface{}{
+					"time":       time.Now(),
+					"level":      "trace",
+					"msg":        "dropped duplicate cloud logging entries",
+					"entries":    len(entries),
+					"duplicates": duplicates,
+					"project":    project,
+					"filter":     filter,
+				})
 			}
+
 			if !conf.Follow {
 				w.Close()
 				return
@@ -54,7 +201,21 @@ func gcloudStream(conf Config, filter string) io.ReadCloser {
 		}
 	}()
 
-	return r
+	return Stream{
+		ReadCloser: r,
+		Fields:     fields,
+	}
+}
+
+func gcloudErrorEntry(msg string, err error, project, filter string) map[string]interface{} {
+	return map[string]interface{}{
+		"time":    time.Now(),
+		"level":   "error",
+		"msg":     msg,
+		"error":   err.Error(),
+		"project": project,
+		"filter":  filter,
+	}
 }
 
 func Tick(d time.Duration) <-chan time.Time {
@@ -80,103 +241,206 @@ func Tick(d time.Duration) <-chan time.Time {
 	return c
 }
 
-func gcloudStreamEntries(conf Config, lastTimestamp time.Time, filter string) ([]Entry, error) {
-	cmdName, args := gcloudStreamBuildCmd(conf, lastTimestamp, filter)
-
-	cmd := exec.Command(cmdName, args...)
-	out := &bytes.Buffer{}
-	cmd.Stdout = out
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		return nil, err
+// gcloudStreamEntries lists the entries since from (included), in chronological order.
+// On the first poll (when from is zero), only the last -tail entries are kept.
+func gcloudStreamEntries(conf Config, logging CloudLogging, project, filter string, from time.Time) ([]Entry, error) {
+	req := ListEntriesRequest{
+		ResourceNames: []string{"projects/" + project},
+		Filter:        gcloudFilter(conf, filter, from, time.Now()),
+		OrderBy:       "timestamp asc",
+		PageSize:      cloudLoggingPageSize,
+	}
+	limit := -1
+	if from.IsZero() && conf.Tail >= 0 {
+		req.OrderBy = "timestamp desc"
+		limit = int(conf.Tail)
 	}
 
 	var entries []Entry
+	for limit < 0 || len(entries) < limit {
+		if limit >= 0 && limit-len(entries) < req.PageSize {
+			req.PageSize = limit - len(entries)
+		}
 
-	err = json.NewDecoder(out).Decode(&entries)
-	if err != nil {
-		return nil, err
+		ctx, cancel := context.WithTimeout(context.Background(), CloudLoggingTimeout)
+		resp, err := logging.ListEntries(ctx, req)
+		cancel()
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, resp.Entries...)
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+
+	if limit >= 0 {
+		if len(entries) > limit {
+			entries = entries[:limit]
+		}
+		// entries are in reverse chronological order
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
 	}
 
 	return entries, nil
 }
 
-func gcloudStreamBuildCmd(conf Config, lastTimestamp time.Time, filter string) (string, []string) {
-	if !lastTimestamp.IsZero() {
-		filter += " timestamp>=" + strconv.Quote(lastTimestamp.UTC().Format(time.RFC3339))
+func gcloudFilter(conf Config, filter string, from, now time.Time) string {
+	since := from
+	if since.IsZero() {
+		freshness := conf.Since
+		if freshness <= 0 {
+			freshness = gcloudDefaultFreshness
+		}
+		since = now.Add(-freshness)
 	}
 
-	args := []string{
-		"logging", "read",
-		filter,
-		"--format=json",
+	timestampFilter := "timestamp>=" + strconv.Quote(since.UTC().Format(time.RFC3339Nano))
+	if strings.TrimSpace(filter) == "" {
+		return timestampFilter
 	}
-	if lastTimestamp.IsZero() && conf.Since > 0 {
-		args = append(args, "--freshness="+conf.Since.String())
+
+	return "(" + filter + ") AND " + timestampFilter
+}
+
+// dedupWindow remembers the insert IDs of the entries until they are older than the lower bound of the polls.
+type dedupWindow struct {
+	ids map[string]time.Time
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{
+		ids: make(map[string]time.Time, 1000),
 	}
-	if conf.Tail >= 0 {
-		args = append(args, "--limit="+strconv.FormatInt(conf.Tail, 10))
+}
+
+// Seen reports whether the entry was already seen, and remembers it otherwise.
+func (w *dedupWindow) Seen(insertID string, t time.Time) bool {
+	if _, ok := w.ids[insertID]; ok {
+		return true
 	}
+	w.ids[insertID] = t
+
+	return false
+}
 
-	return "gcloud", args
+// Forget drops the entries strictly older than before. Entries sharing the boundary timestamp are kept,
+// since polls list entries with timestamp>=before.
+func (w *dedupWindow) Forget(before time.Time) {
+	for id, t := range w.ids {
+		if t.Before(before) {
+			delete(w.ids, id)
+		}
+	}
 }
 
 type Entry struct {
-	JSONPayload json.RawMessage
-	Severity    string
-	Timestamp   time.Time
-	InsertID    string
+	JSONPayload  json.RawMessage
+	TextPayload  string
+	ProtoPayload json.RawMessage
+	Severity     string
+	Timestamp    time.Time
+	InsertID     string
+	Resource     *EntryResource         `json:",omitempty"`
+	Labels       map[string]string      `json:",omitempty"`
+	Trace        string                 `json:",omitempty"`
+	SpanID       string                 `json:"spanId,omitempty"`
+	HTTPRequest  map[string]interface{} `json:"httpRequest,omitempty"`
 
 	msg     string
 	payload map[string]interface{}
 }
 
-var severityMap = map[string]string{
-	"INFO":  "info",
-	"ERROR": "error",
+type EntryResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
+var exceptionKeys = []string{"exception", "Exception", "stack_trace"}
+
 func (e *Entry) ToLogrus() map[string]interface{} {
 	payload := e.Payload()
-	logrusEntry := make(map[string]interface{}, len(payload)+3)
+	logrusEntry := make(map[string]interface{}, len(payload)+8)
 
-	// TODO: flatten .Exception
 	for k, v := range payload {
 		switch k {
-		case "msg", "time", "level":
+		case "msg", "time", "level", "stacktrace", "resource", "labels", "trace", "spanId", "httpRequest":
 			k = "entry." + k
 		}
 
 		logrusEntry[k] = v
 	}
 
+	for _, k := range exceptionKeys {
+		v, ok := payload[k]
+		if !ok {
+			continue
+		}
+		if stacktrace := flattenException(v); stacktrace != "" {
+			delete(logrusEntry, k)
+			logrusEntry["stacktrace"] = stacktrace
+			break
+		}
+	}
+
 	logrusEntry["time"] = e.Timestamp
 	logrusEntry["msg"] = e.Message()
 	switch logrusEntry["msg"] {
 	case "", "-":
-		logrusEntry["msg"] = payload["msg"]
+		if msg, ok := payload["msg"]; ok {
+			logrusEntry["msg"] = msg
+		}
 	}
 
-	if level, ok := severityMap[e.Severity]; ok {
+	if level, ok := normalize.SeverityLevel(e.Severity); ok {
 		logrusEntry["level"] = level
 	} else {
 		logrusEntry["level"] = "panic"
 	}
 
+	if e.Resource != nil {
+		logrusEntry["resource"] = e.Resource
+	}
+	if len(e.Labels) != 0 {
+		logrusEntry["labels"] = e.Labels
+	}
+	if e.Trace != "" {
+		logrusEntry["trace"] = e.Trace
+	}
+	if e.SpanID != "" {
+		logrusEntry["spanId"] = e.SpanID
+	}
+	if len(e.HTTPRequest) != 0 {
+		logrusEntry["httpRequest"] = e.HTTPRequest
+	}
+
 	return logrusEntry
 }
 
+// Payload returns the fields of the JSON payload or, for entries such as audit logs, of the proto payload.
 func (e *Entry) Payload() map[string]interface{} {
 	if e.payload != nil {
 		return e.payload
 	}
 
-	err := json.Unmarshal(e.JSONPayload, &e.payload)
-	if err != nil {
+	raw := e.JSONPayload
+	if len(raw) == 0 {
+		raw = e.ProtoPayload
+	}
+	if len(raw) == 0 {
+		e.payload = map[string]interface{}{}
+		return e.payload
+	}
+
+	err := json.Unmarshal(raw, &e.payload)
+	if err != nil || e.payload == nil {
 		e.payload = map[string]interface{}{
-			"log_bytes": []byte(e.JSONPayload),
-			"log_error": err,
+			"log_bytes": []byte(raw),
+			"log_error": fmt.Sprint(err),
 		}
 	}
 
@@ -188,6 +452,22 @@ func (e *Entry) Message() string {
 		return e.msg
 	}
 
+	switch {
+	case e.TextPayload != "":
+		e.msg = strings.TrimRight(e.TextPayload, "\n")
+	case len(e.JSONPayload) != 0:
+		e.msg = jsonPayloadMessage(e.JSONPayload)
+	case len(e.ProtoPayload) != 0:
+		e.msg = protoPayloadMessage(e.ProtoPayload)
+	}
+	if e.msg == "" {
+		e.msg = "-"
+	}
+
+	return e.msg
+}
+
+func jsonPayloadMessage(b json.RawMessage) string {
 	var payload struct {
 		Message   string
 		Exception struct {
@@ -195,20 +475,90 @@ func (e *Entry) Message() string {
 		}
 	}
 
-	err := json.Unmarshal(e.JSONPayload, &payload)
+	err := json.Unmarshal(b, &payload)
 	if err != nil {
-		e.msg = "-"
-		return e.msg
+		return ""
 	}
-	if payload.Message == "" && payload.Exception.Message == "" {
-		e.msg = "-"
-		return e.msg
+	if payload.Message == "" {
+		return payload.Exception.Message
 	}
-	if payload.Message == "" && payload.Exception.Message != "" {
-		e.msg = payload.Exception.Message
-		return e.msg
+
+	return payload.Message
+}
+
+// protoPayloadMessage describes proto payloads like audit logs, using the method and resource names.
+func protoPayloadMessage(b json.RawMessage) string {
+	var payload struct {
+		MethodName   string
+		ResourceName string
+		Status       struct {
+			Message string
+		}
 	}
 
-	e.msg = payload.Message
-	return e.msg
+	err := json.Unmarshal(b, &payload)
+	if err != nil {
+		return ""
+	}
+
+	msg := strings.TrimSpace(payload.MethodName + " " + payload.ResourceName)
+	if payload.Status.Message != "" {
+		msg += ": " + payload.Status.Message
+	}
+
+	return msg
+}
+
+// flattenException renders an exception as a stack trace. Exceptions can be plain strings or objects with
+// the type, message and stack trace of the exception, and possibly an inner exception.
+func flattenException(v interface{}) string {
+	switch exception := v.(type) {
+	case string:
+		return exception
+	case map[string]interface{}:
+		header := strings.TrimSpace(lookupString(exception, "ClassName", "Type", "type", "class") + ": " +
+			lookupString(exception, "Message", "message"))
+		header = strings.Trim(header, ": ")
+
+		lines := []string{}
+		if header != "" {
+			lines = append(lines, header)
+		}
+		stack := lookup(exception, "StackTraceString", "StackTrace", "stackTrace", "stack_trace", "stack")
+		switch stack := stack.(type) {
+		case string:
+			lines = append(lines, stack)
+		case []interface{}:
+			for _, frame := range stack {
+				lines = append(lines, fmt.Sprint(frame))
+			}
+		}
+
+		inner := lookup(exception, "InnerException", "innerException", "cause")
+		if inner != nil {
+			if s := flattenException(inner); s != "" {
+				lines = append(lines, "---> "+s)
+			}
+		}
+
+		return strings.Join(lines, "\n")
+	default:
+		return ""
+	}
+}
+
+func lookup(m map[string]interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		if v, ok := m[k]; ok && v != nil {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func lookupString(m map[string]interface{}, keys ...string) string {
+	s, _ := lookup(m, keys...).(string)
+
+	return s
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testEntries(n int) []Entry {
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = Entry{
+			TextPayload: fmt.Sprintf("entry %d", i),
+			Severity:    "INFO",
+			Timestamp:   testEpoch.Add(time.Duration(i) * time.Second),
+			InsertID:    strconv.Itoa(i),
+		}
+	}
+
+	return entries
+}
+
+// fakeCloudLogging serves the entries:list method of the Cloud Logging API, in pages of pageSize entries.
+type fakeCloudLogging struct {
+	entries  []Entry
+	pageSize int
+
+	requests []ListEntriesRequest
+	m        sync.Mutex
+}
+
+func (f *fakeCloudLogging) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v2/entries:list" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req ListEntriesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, `{"error": {"message": "invalid request", "status": "INVALID_ARGUMENT"}}`, http.StatusBadRequest)
+		return
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.requests = append(f.requests, req)
+
+	entries := make([]Entry, len(f.entries))
+	copy(entries, f.entries)
+	if req.OrderBy == "timestamp desc" {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+
+	start, _ := strconv.Atoi(req.PageToken)
+	size := f.pageSize
+	if req.PageSize > 0 && req.PageSize < size {
+		size = req.PageSize
+	}
+	end := start + size
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	resp := ListEntriesResponse{
+		Entries: entries[start:end],
+	}
+	if end < len(entries) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func testCloudLogging(t *testing.T, fake *fakeCloudLogging) CloudLogging {
+	t.Helper()
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return &cloudLoggingClient{
+		client:   srv.Client(),
+		endpoint: srv.URL,
+	}
+}
+
+func entryMessages(entries []Entry) []string {
+	msgs := make([]string, len(entries))
+	for i := range entries {
+		msgs[i] = entries[i].Message()
+	}
+
+	return msgs
+}
+
+func TestGcloudStreamEntriesPaging(t *testing.T) {
+	tests := []struct {
+		name      string
+		tail      int64
+		from      time.Time
+		want      []string
+		wantPages int
+	}{
+		{
+			name:      "all pages",
+			tail:      -1,
+			want:      entryMessages(testEntries(7)),
+			wantPages: 3,
+		},
+		{
+			name:      "tail across pages",
+			tail:      4,
+			want:      []string{"entry 3", "entry 4", "entry 5", "entry 6"},
+			wantPages: 2,
+		},
+		{
+			name:      "tail ignored after the first poll",
+			tail:      2,
+			from:      testEpoch,
+			want:      entryMessages(testEntries(7)),
+			wantPages: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeCloudLogging{
+				entries:  testEntries(7),
+				pageSize: 3,
+			}
+			logging := testCloudLogging(t, fake)
+
+			entries, err := gcloudStreamEntries(Config{Tail: test.tail}, logging, "my-project", `resource.type="k8s_container"`, test.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entryMessages(entries); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("entries = %v, want %v", got, test.want)
+			}
+			if len(fake.requests) != test.wantPages {
+				t.Errorf("%d requests, want %d", len(fake.requests), test.wantPages)
+			}
+			for _, req := range fake.requests {
+				if !reflect.DeepEqual(req.ResourceNames, []string{"projects/my-project"}) {
+					t.Errorf("resource names = %v, want the project", req.ResourceNames)
+				}
+				if !strings.HasPrefix(req.Filter, `(resource.type="k8s_container") AND timestamp>=`) {
+					t.Errorf("filter = %q", req.Filter)
+				}
+			}
+		})
+	}
+}
+
+func TestCloudLoggingError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error": {"message": "permission denied", "status": "PERMISSION_DENIED"}}`))
+	}))
+	defer srv.Close()
+
+	logging := &cloudLoggingClient{
+		client:   srv.Client(),
+		endpoint: srv.URL,
+	}
+	_, err := logging.ListEntries(context.Background(), ListEntriesRequest{})
+	if err == nil || err.Error() != "cloud logging: permission denied (PERMISSION_DENIED)" {
+		t.Errorf("error = %v", err)
+	}
+}
+
+// fakePolls returns overlapping entries on each poll, like the Cloud Logging API does when polls start
+// before the last entry seen.
+type fakePolls struct {
+	polls [][]Entry
+	n     int
+	m     sync.Mutex
+}
+
+func (f *fakePolls) ListEntries(_ context.Context, req ListEntriesRequest) (ListEntriesResponse, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.n >= len(f.polls) {
+		return ListEntriesResponse{}, nil
+	}
+	f.n++
+
+	return ListEntriesResponse{
+		Entries: f.polls[f.n-1],
+	}, nil
+}
+
+func TestGcloudStreamDedup(t *testing.T) {
+	entries := testEntries(6)
+	// entries 3 and 4 share their timestamp, 4 is only listed on the last poll
+	entries[4].Timestamp = entries[3].Timestamp
+	logging := &fakePolls{
+		polls: [][]Entry{
+			entries[0:4],
+			{entries[2], entries[3]},
+			{entries[3], entries[4], entries[5]},
+		},
+	}
+
+	stream := gcloudStream(Config{Follow: true, Tail: -1, GcloudPoll: 10 * time.Millisecond, GcloudOverlap: time.Second}, logging, "my-project/severity>=INFO")
+	defer stream.Close()
+	if stream.Fields["_project"] != "my-project" || stream.Fields["_filter"] != "severity>=INFO" {
+		t.Errorf("fields = %v", stream.Fields)
+	}
+
+	got := []string{}
+	duplicates, traces := 0, 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		r := bufio.NewReader(stream)
+		for len(got) < len(entries) || duplicates < 3 {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var entry struct {
+				Level      string
+				Msg        string
+				Duplicates int
+			}
+			_ = json.Unmarshal([]byte(line), &entry)
+			if entry.Level == "trace" {
+				duplicates += entry.Duplicates
+				traces++
+				continue
+			}
+			got = append(got, entry.Msg)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the entries")
+	}
+
+	if want := entryMessages(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+	if duplicates != 3 || traces != 2 {
+		t.Errorf("%d duplicates reported in %d traces, want 3 in 2 (only for the polls with duplicates)", duplicates, traces)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	window := newDedupWindow()
+
+	if window.Seen("a", testEpoch) {
+		t.Error("a seen before being added")
+	}
+	if !window.Seen("a", testEpoch) {
+		t.Error("a not seen after being added")
+	}
+	window.Seen("b", testEpoch.Add(time.Second))
+
+	window.Forget(testEpoch)
+	if !window.Seen("a", testEpoch) {
+		t.Error("entry on the boundary forgotten")
+	}
+
+	window.Forget(testEpoch.Add(time.Second))
+	if window.Seen("a", testEpoch) {
+		t.Error("entry before the boundary not forgotten")
+	}
+	if !window.Seen("b", testEpoch.Add(time.Second)) {
+		t.Error("entry on the boundary forgotten")
+	}
+}
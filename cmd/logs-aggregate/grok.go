@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Pimmr/logs-dashboard/internal/grok"
+)
+
+// SourcePattern is an extraction pattern applied to the streams with a field matching a pattern.
+type SourcePattern struct {
+	Field   string
+	Pattern string
+	Expr    string
+}
+
+// SourcePatterns are parsed from 'field=pattern:expression', like SourceFilters.
+type SourcePatterns []SourcePattern
+
+func (p SourcePatterns) String() string {
+	ss := make([]string, len(p))
+	for i, sp := range p {
+		ss[i] = fmt.Sprintf("%s=%s:%s", sp.Field, sp.Pattern, sp.Expr)
+	}
+
+	return strings.Join(ss, "; ")
+}
+
+func (p *SourcePatterns) Set(s string) error {
+	field, pattern, expr, err := parseSourceSelector(s, "source pattern", "expression")
+	if err != nil {
+		return err
+	}
+	if _, err := grok.Compile(expr); err != nil {
+		return fmt.Errorf("invalid source pattern %q: %v", s, err)
+	}
+
+	*p = append(*p, SourcePattern{
+		Field:   field,
+		Pattern: pattern,
+		Expr:    expr,
+	})
+
+	return nil
+}
+
+// LineParser converts the raw lines of the streams to JSON with the -grok patterns and the source patterns
+// matching each stream. The source patterns are tried first.
+type LineParser struct {
+	patterns grok.Patterns
+	sources  []sourcePattern
+}
+
+type sourcePattern struct {
+	SourcePattern
+	pattern *grok.Pattern
+}
+
+func NewLineParser(conf Config) (*LineParser, error) {
+	patterns, err := grok.CompileAll(conf.Grok)
+	if err != nil {
+		return nil, err
+	}
+	lp := &LineParser{
+		patterns: patterns,
+	}
+
+	for _, sp := range conf.SourceGrok {
+		p, err := grok.Compile(sp.Expr)
+		if err != nil {
+			return nil, err
+		}
+		lp.sources = append(lp.sources, sourcePattern{
+			SourcePattern: sp,
+			pattern:       p,
+		})
+	}
+
+	return lp, nil
+}
+
+// Stream returns the patterns applying to a stream.
+func (lp *LineParser) Stream(fields map[string]interface{}) grok.Patterns {
+	patterns := grok.Patterns{}
+	for _, sp := range lp.sources {
+		if matchSource(fields, sp.Field, sp.Pattern) {
+			patterns = append(patterns, sp.pattern)
+		}
+	}
+
+	return append(patterns, lp.patterns...)
+}
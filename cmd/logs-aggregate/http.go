@@ -1,77 +1,287 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
-func httpStream(addr string, follow bool) io.ReadCloser {
+const HTTPTagHeader = "X-Logs-Tag"
+
+var (
+	// HTTPMaxBodySize is the maximum size of the bodies POSTed over HTTP, compressed or not.
+	HTTPMaxBodySize int64 = 16 << 20
+
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errBodyTooLarge        = errors.New("request body too large")
+)
+
+func httpStream(addr, token string, trustedProxies []*net.IPNet, tag bool) (Stream, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return Stream{}, err
+	}
+
 	r, w := io.Pipe()
 	srv := &http.Server{
-		Addr: addr,
+		Handler: &httpIngest{
+			w:              w,
+			token:          token,
+			trustedProxies: trustedProxies,
+			tag:            tag,
+		},
 	}
 
-	close := func() error {
+	go func() {
+		err := srv.Serve(listener)
+		if err == http.ErrServerClosed {
+			return
+		}
+		if err != nil {
+			_ = w.CloseWithError(err)
+		}
+	}()
+
+	rClose := func() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 		defer cancel()
 		err := srv.Shutdown(ctx)
+		_ = w.Close()
+		_ = r.Close()
+
+		return err
+	}
+
+	return Stream{
+		ReadCloser: readCloser{
+			Reader:  r,
+			closeFn: rClose,
+		},
+		Fields: map[string]interface{}{
+			"_source": "http",
+		},
+	}, nil
+}
+
+// httpIngest writes the lines POSTed as NDJSON (optionally gzip-encoded) to w.
+// Callers can tag their lines using the X-Logs-Tag header or the tag query parameter. With tag, the lines are
+// tagged with the address of the client, taken from X-Forwarded-For when the request comes from a trusted proxy.
+type httpIngest struct {
+	w              io.Writer
+	token          string
+	trustedProxies []*net.IPNet
+	tag            bool
+}
+
+func (h *httpIngest) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("method %q not allowed, use %q", req.Method, http.MethodPost), http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="logs-aggregate"`)
+		http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	defer req.Body.Close()
+	req.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, req.Body, HTTPMaxBodySize)}
+
+	// the body is read entirely before writing any line, so that a request failing with an error can be
+	// retried without duplicating lines
+	lines, status, err := readLines(req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	fields := h.fields(req)
+	for _, line := range lines {
+		if len(fields) != 0 {
+			line = tagLine(line, fields)
+		}
+		_, err := io.WriteString(h.w, line+"\n")
 		if err != nil {
-			w.Close()
-			return err
+			http.Error(w, "logs stream closed", http.StatusServiceUnavailable)
+			return
 		}
-		return w.Close()
 	}
 
-	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodPost {
-			http.Error(w, fmt.Sprintf("method %q not allowed, use %q", req.Method, http.MethodPost), http.StatusMethodNotAllowed)
-			return
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "%d lines accepted\n", len(lines))
+}
+
+// readLines reads the non-empty lines of the body, returning the status to reply with on errors.
+func readLines(req *http.Request) ([]string, int, error) {
+	body, err := decodeBody(req)
+	if err == errUnsupportedEncoding {
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", req.Header.Get("Content-Encoding"))
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("decoding body: %v", err)
+	}
+	defer body.Close()
+
+	lines := []string{}
+	size := int64(0)
+	r := bufio.NewReader(body)
+	for {
+		line, err := r.ReadString('\n')
+		size += int64(len(line))
+		if size > HTTPMaxBodySize {
+			return nil, http.StatusRequestEntityTooLarge, errBodyTooLarge
 		}
-		defer req.Body.Close()
-		_, err := io.Copy(w, req.Body)
-		if err == io.EOF && follow {
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("OK"))
-			return
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
 		}
 		if err == io.EOF {
-			err = close()
-			if err != nil {
-				_, _ = w.Write([]byte("Error: " + err.Error()))
+			return lines, http.StatusOK, nil
+		}
+		if errors.Is(err, errBodyTooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, errBodyTooLarge
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("reading body: %v", err)
+		}
+	}
+}
+
+// limitedBody reports the errors of http.MaxBytesReader once the limit was read as errBodyTooLarge.
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF && b.n >= HTTPMaxBodySize {
+		return n, errBodyTooLarge
+	}
+
+	return n, err
+}
+
+func (h *httpIngest) authorized(req *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *httpIngest) fields(req *http.Request) map[string]interface{} {
+	fields := map[string]interface{}{}
+
+	tag := req.Header.Get(HTTPTagHeader)
+	if tag == "" {
+		tag = req.URL.Query().Get("tag")
+	}
+	if tag != "" {
+		fields["_tag"] = tag
+	}
+	if h.tag {
+		fields["_remote_addr"] = h.remoteAddr(req)
+	}
+
+	return fields
+}
+
+// remoteAddr returns the address of the client. When the request comes from a trusted proxy, it is the last
+// address of X-Forwarded-For that is not a trusted proxy.
+func (h *httpIngest) remoteAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || !h.trusted(host) {
+		return req.RemoteAddr
+	}
+
+	var forwarded []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
 			}
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte("OK"))
-			return
 		}
+	}
+	if len(forwarded) == 0 {
+		return req.RemoteAddr
+	}
 
-		http.Error(w, fmt.Sprintf("unexpected error: %v", err), http.StatusInternalServerError)
-	})
+	for i := len(forwarded) - 1; i > 0; i-- {
+		if !h.trusted(forwarded[i]) {
+			return forwarded[i]
+		}
+	}
 
-	go func() {
-		err := srv.ListenAndServe()
-		if err == http.ErrServerClosed {
-			return
+	return forwarded[0]
+}
+
+func (h *httpIngest) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range h.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
 		}
-		if err != nil {
-			_, _ = w.Write([]byte("Error: " + err.Error()))
+	}
+
+	return false
+}
+
+// parseTrustedProxies parses addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
-	}()
 
-	rClose := func() error {
-		err := close()
+		_, ipNet, err := net.ParseCIDR(proxy)
 		if err != nil {
-			r.Close()
-			return err
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
 		}
-		return r.Close()
+		nets = append(nets, ipNet)
 	}
 
-	return readCloser{
-		Reader:  r,
-		closeFn: rClose,
+	return nets, nil
+}
+
+func decodeBody(req *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return ioutil.NopCloser(req.Body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(req.Body)
+	default:
+		return nil, errUnsupportedEncoding
 	}
 }
 
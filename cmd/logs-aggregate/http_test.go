@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipBody(t *testing.T, s string) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	_, err := zw.Write([]byte(s))
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
+
+func TestHTTPIngest(t *testing.T) {
+	const body = "{\"msg\":\"a\"}\n\n{\"msg\":\"b\"}\nplain text"
+	truncated := gzipBody(t, body)
+	truncated = truncated[:len(truncated)-4]
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		headers    map[string]string
+		body       string
+		token      string
+		tag        bool
+		wantStatus int
+		wantLines  string
+	}{
+		{
+			name:       "ndjson",
+			body:       body,
+			wantStatus: http.StatusOK,
+			wantLines:  "{\"msg\":\"a\"}\n{\"msg\":\"b\"}\nplain text\n",
+		},
+		{
+			name:       "gzip",
+			headers:    map[string]string{"Content-Encoding": "gzip"},
+			body:       gzipBody(t, body),
+			wantStatus: http.StatusOK,
+			wantLines:  "{\"msg\":\"a\"}\n{\"msg\":\"b\"}\nplain text\n",
+		},
+		{
+			name:       "invalid gzip",
+			headers:    map[string]string{"Content-Encoding": "gzip"},
+			body:       body,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "truncated gzip",
+			headers:    map[string]string{"Content-Encoding": "gzip"},
+			body:       truncated,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unsupported encoding",
+			headers:    map[string]string{"Content-Encoding": "br"},
+			body:       body,
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "too large",
+			body:       strings.Repeat("{\"msg\":\"a\"}\n", 200),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "too large once decompressed",
+			headers:    map[string]string{"Content-Encoding": "gzip"},
+			body:       gzipBody(t, strings.Repeat("{\"msg\":\"a\"}\n", 200)),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "method",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "missing token",
+			token:      "secret",
+			body:       body,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid token",
+			token:      "secret",
+			headers:    map[string]string{"Authorization": "Bearer nope"},
+			body:       body,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "token",
+			token:      "secret",
+			headers:    map[string]string{"Authorization": "Bearer secret"},
+			body:       `{"msg":"a"}`,
+			wantStatus: http.StatusOK,
+			wantLines:  "{\"msg\":\"a\"}\n",
+		},
+		{
+			name:       "tag header",
+			headers:    map[string]string{HTTPTagHeader: "deploy"},
+			body:       `{"msg":"a"}`,
+			wantStatus: http.StatusOK,
+			wantLines:  "{\"_tag\":\"deploy\",\"msg\":\"a\"}\n",
+		},
+		{
+			name:       "tag query parameter",
+			target:     "/?tag=ci",
+			body:       "plain text",
+			wantStatus: http.StatusOK,
+			wantLines:  "{\"_tag\":\"ci\",\"msg\":\"plain text\"}\n",
+		},
+		{
+			name:       "remote address",
+			tag:        true,
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.7"},
+			body:       `{"msg":"a"}`,
+			wantStatus: http.StatusOK,
+			wantLines:  "{\"_remote_addr\":\"192.0.2.1:1234\",\"msg\":\"a\"}\n",
+		},
+	}
+
+	defer func(size int64) { HTTPMaxBodySize = size }(HTTPMaxBodySize)
+	HTTPMaxBodySize = 1024
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lines bytes.Buffer
+			h := &httpIngest{
+				w:     &lines,
+				token: test.token,
+				tag:   test.tag,
+			}
+
+			method, target := test.method, test.target
+			if method == "" {
+				method = http.MethodPost
+			}
+			if target == "" {
+				target = "/"
+			}
+			req := httptest.NewRequest(method, target, strings.NewReader(test.body))
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != test.wantStatus {
+				t.Errorf("status = %d (%q), want %d", rec.Code, rec.Body.String(), test.wantStatus)
+			}
+			if got := lines.String(); got != test.wantLines {
+				t.Errorf("lines = %q, want %q", got, test.wantLines)
+			}
+		})
+	}
+}
+
+func TestHTTPIngestRemoteAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.7:5555",
+			want:       "203.0.113.7:5555",
+		},
+		{
+			name:       "untrusted proxy",
+			remoteAddr: "203.0.113.7:5555",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7:5555",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "192.0.2.1:5555",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted proxies chain",
+			remoteAddr: "10.1.2.3:5555",
+			forwarded:  []string{"6.6.6.6, 198.51.100.1", "10.0.0.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "only trusted proxies",
+			remoteAddr: "10.1.2.3:5555",
+			forwarded:  []string{"10.0.0.2, 10.0.0.1"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "trusted proxy without forwarded address",
+			remoteAddr: "10.1.2.3:5555",
+			want:       "10.1.2.3:5555",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &httpIngest{
+				trustedProxies: proxies,
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, forwarded := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", forwarded)
+			}
+
+			if got := h.remoteAddr(req); got != test.want {
+				t.Errorf("remote address = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, proxy := range []string{"localhost", "10.0.0.0/33"} {
+		_, err := parseTrustedProxies([]string{proxy})
+		if err == nil {
+			t.Errorf("expected an error for %q", proxy)
+		}
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	stream, err := httpStream(addr, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, _ := io.ReadAtLeast(stream, b, len("{\"msg\":\"a\"}\n"))
+		lines <- string(b[:n])
+	}()
+
+	resp, err := http.Post("http://"+addr, "application/x-ndjson", strings.NewReader(`{"msg":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "1 lines accepted\n" {
+		t.Errorf("response = %d %q", resp.StatusCode, body)
+	}
+	if got := <-lines; got != "{\"msg\":\"a\"}\n" {
+		t.Errorf("stream read %q", got)
+	}
+
+	err = stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
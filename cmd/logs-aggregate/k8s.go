@@ -4,75 +4,153 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
 	"time"
 
-	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
 
+var errStreamDetached = errors.New("stream detached")
+
 type Kubernetes struct {
-	replicasets map[string]appsv1.ReplicaSet
-	pods        map[string]v1.Pod
+	replicasets appslisters.ReplicaSetLister
+	jobs        batchlisters.JobLister
+	pods        corelisters.PodLister
 
-	clientset          *kubernetes.Clientset
+	clientset          kubernetes.Interface
+	context            string
 	namespace          string
 	containersOverride ConfigMap
+	allContainers      bool
+	includeContainers  []string
+	excludeContainers  []string
+	initContainers     bool
 	tail               int64
+	restartTail        int64
 	since              time.Duration
 	previous           bool
 	follow             bool
+	events             bool
+
+	podNames  []string
+	workloads []workload
+	selectors []labels.Selector
+
+	attached map[string][]io.ReadCloser
+	m        *sync.Mutex
+
+	// openLogs opens a logs stream of a pod, through the clientset unless replaced in tests.
+	openLogs func(namespace, podName string, opts *v1.PodLogOptions) (io.ReadCloser, error)
 }
 
 func NewKubernetes(conf Config) (*Kubernetes, error) {
-	var err error
+	// create the clientset
+	clientset, context, namespace, err := setupClient(conf.KubeConfig, conf.Context, conf.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKubernetes(clientset, context, namespace, conf)
+}
+
+func newKubernetes(clientset kubernetes.Interface, context, namespace string, conf Config) (*Kubernetes, error) {
+	if conf.AllNamespaces {
+		namespace = metav1.NamespaceAll
+	}
 
 	k8s := &Kubernetes{
+		clientset:          clientset,
+		context:            context,
+		namespace:          namespace,
 		containersOverride: conf.Containers,
+		allContainers:      conf.AllContainers || conf.InitContainers || len(conf.IncludeContainers) != 0 || len(conf.ExcludeContainers) != 0,
+		includeContainers:  conf.IncludeContainers,
+		excludeContainers:  conf.ExcludeContainers,
+		initContainers:     conf.InitContainers,
 		follow:             conf.Follow,
 		tail:               conf.Tail,
+		restartTail:        conf.RestartTail,
 		since:              conf.Since,
 		previous:           conf.Previous,
+		events:             conf.Events,
 
-		replicasets: map[string]appsv1.ReplicaSet{},
-		pods:        map[string]v1.Pod{},
-	}
+		podNames:  conf.Pods,
+		workloads: workloads(conf),
 
-	// create the clientset
-	k8s.clientset, k8s.namespace, err = setupClient(conf.KubeConfig, conf.Context, conf.Namespace)
-	if err != nil {
-		return nil, err
+		attached: map[string][]io.ReadCloser{},
+		m:        &sync.Mutex{},
 	}
+	k8s.openLogs = k8s.clientsetLogs
 
-	replicasets, err := k8s.clientset.AppsV1().ReplicaSets(k8s.namespace).List(metav1.ListOptions{})
-	if err != nil {
-		return nil, err
-	}
-
-	for _, replicaset := range replicasets.Items {
-		if replicaset.Status.Replicas == 0 {
-			continue
+	for _, label := range conf.Labels {
+		selector, err := labels.Parse(label)
+		if err != nil {
+			return nil, fmt.Errorf("parsing selector %q: %w", label, err)
 		}
-		k8s.replicasets[replicaset.GetName()] = replicaset
+		k8s.selectors = append(k8s.selectors, selector)
 	}
 
-	pods, err := k8s.clientset.CoreV1().Pods(k8s.namespace).List(metav1.ListOptions{})
-	if err != nil {
-		return nil, err
+	return k8s, nil
+}
+
+// workload is a pod controller, identified by the prefix used for its key in the containers override
+// ("deploy", "sts", ...) and its name.
+type workload struct {
+	kind string
+	name string
+}
+
+// workloadOwners lists the kinds of the owner references to follow from a pod to reach a workload.
+var workloadOwners = map[string][]string{
+	"deploy":  {"ReplicaSet", "Deployment"},
+	"sts":     {"StatefulSet"},
+	"ds":      {"DaemonSet"},
+	"job":     {"Job"},
+	"cronjob": {"Job", "CronJob"},
+}
+
+func workloads(conf Config) []workload {
+	kinds := []struct {
+		kind  string
+		names []string
+	}{
+		{"deploy", conf.Deployments},
+		{"sts", conf.StatefulSets},
+		{"ds", conf.DaemonSets},
+		{"job", conf.Jobs},
+		{"cronjob", conf.CronJobs},
 	}
-	for _, pod := range pods.Items {
-		k8s.pods[pod.GetName()] = pod
+
+	ww := []workload{}
+	for _, k := range kinds {
+		for _, name := range k.names {
+			ww = append(ww, workload{
+				kind: k.kind,
+				name: name,
+			})
+		}
 	}
 
-	return k8s, nil
+	return ww
 }
 
-func setupClient(kubeconfig, contextOverride, namespaceOverride string) (*kubernetes.Clientset, string, error) {
+func setupClient(kubeconfig, contextOverride, namespaceOverride string) (*kubernetes.Clientset, string, string, error) {
 	if kubeconfig == "" {
-		return nil, "", errors.New("missing kubeconfig path")
+		return nil, "", "", errors.New("missing kubeconfig path")
 	}
 
 	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
@@ -87,123 +165,420 @@ func setupClient(kubeconfig, contextOverride, namespaceOverride string) (*kubern
 		},
 	)
 
+	context := contextOverride
+	rawConfig, rawErr := config.RawConfig()
+	if context == "" && rawErr == nil {
+		context = rawConfig.CurrentContext
+	}
+
 	namespace, ok, err := config.Namespace()
 	if err != nil {
-		return nil, "", err
+		return nil, context, "", err
 	}
-	if !ok {
-		rawConfig, err := config.RawConfig()
-		if err == nil {
-			if ctx, ok := rawConfig.Contexts[rawConfig.CurrentContext]; ok {
-				namespace = ctx.Namespace
-			}
+	if !ok && rawErr == nil {
+		if ctx, ok := rawConfig.Contexts[context]; ok {
+			namespace = ctx.Namespace
 		}
 	}
 
 	restConfig, err := config.ClientConfig()
 	if err != nil {
-		return nil, namespace, err
+		return nil, context, namespace, err
 	}
 
 	// create the clientset
 	clientset, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
-		return nil, namespace, err
+		return nil, context, namespace, err
 	}
 
-	return clientset, namespace, nil
+	return clientset, context, namespace, nil
 }
 
-func (k8s *Kubernetes) PodLogs(podName string) (io.ReadCloser, error) {
-	pod, ok := k8s.pods[podName]
-	if !ok {
-		return nil, fmt.Errorf("pod %q not found", podName)
+// Stream sends a log stream for every pod matching the requested pods, workloads and selectors, and a stream of
+// their events with -events.
+// In follow mode, it keeps watching the namespace until stop is closed, attaching pods as they start
+// and detaching them when they are deleted.
+func (k8s *Kubernetes) Stream(streams chan<- Stream, stop <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k8s.clientset, 0, informers.WithNamespace(k8s.namespace))
+	podInformer := factory.Core().V1().Pods()
+	k8s.pods = podInformer.Lister()
+	podInformer.Informer()
+
+	// only the owners between the pods and the workloads are listed (the jobs of cronjobs, not of jobs), so that
+	// no other list permission is needed
+	for _, w := range k8s.workloads {
+		switch w.kind {
+		case "deploy":
+			k8s.replicasets = factory.Apps().V1().ReplicaSets().Lister()
+		case "cronjob":
+			k8s.jobs = factory.Batch().V1().Jobs().Lister()
+		}
 	}
 
-	var sinceSeconds *int64
-	if k8s.since > 0 {
-		sinceSeconds = new(int64)
-		*sinceSeconds = int64(k8s.since / time.Second)
+	var eventInformer coreinformers.EventInformer
+	if k8s.events {
+		eventInformer = factory.Core().V1().Events()
+		eventInformer.Informer()
 	}
 
-	var tailLinesParam *int64
-	if k8s.tail >= 0 {
-		tailLinesParam = &k8s.tail
+	factory.Start(stop)
+	for typ, ok := range factory.WaitForCacheSync(stop) {
+		if !ok {
+			return fmt.Errorf("failed to sync %v cache", typ)
+		}
 	}
 
-	container, _ := k8s.containersOverride.Match("pod/" + podName)
+	pods, err := k8s.pods.Pods(k8s.namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, podName := range k8s.podNames {
+		if !containsPod(pods, podName) {
+			return fmt.Errorf("pod %q not found", podName)
+		}
+	}
+
+	if k8s.events {
+		stream, err := k8s.EventsStream(eventInformer, stop)
+		if err != nil {
+			return err
+		}
+		streams <- stream
+	}
+
+	if !k8s.follow {
+		return k8s.streamExisting(pods, streams)
+	}
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			k8s.attach(obj, streams)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			k8s.attach(obj, streams)
+			k8s.restarted(obj)
+		},
+		DeleteFunc: k8s.detach,
+	})
 
-	pods := k8s.clientset.CoreV1().Pods(pod.GetNamespace())
-	req := pods.GetLogs(podName, &v1.PodLogOptions{
-		Container:    container,
-		Follow:       k8s.follow,
-		SinceSeconds: sinceSeconds,
-		TailLines:    tailLinesParam,
-		Previous:     k8s.previous,
-	}).Timeout(0)
+	<-stop
+	return nil
+}
+
+func (k8s *Kubernetes) streamExisting(pods []*v1.Pod, streams chan<- Stream) error {
+	sort.Slice(pods, func(i, j int) bool {
+		return podKey(pods[i]) < podKey(pods[j])
+	})
+
+	for _, pod := range pods {
+		if !k8s.match(pod) {
+			continue
+		}
 
-	logs, err := req.Stream()
+		podStreams, err := k8s.PodLogs(pod)
+		if err != nil {
+			return err
+		}
+		for _, stream := range podStreams {
+			streams <- stream
+		}
+	}
+
+	return nil
+}
+
+func (k8s *Kubernetes) attach(obj interface{}, streams chan<- Stream) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || !podStarted(pod) || !k8s.match(pod) {
+		return
+	}
+
+	k8s.m.Lock()
+	if _, ok := k8s.attached[podKey(pod)]; ok {
+		k8s.m.Unlock()
+		return
+	}
+	podStreams, err := k8s.PodLogs(pod)
 	if err != nil {
-		return nil, err
+		k8s.m.Unlock()
+		fmt.Fprintf(os.Stderr, "Error: streaming logs from pod %q: %v\n", pod.GetName(), err)
+		return
+	}
+	attached := make([]io.ReadCloser, len(podStreams))
+	for i, stream := range podStreams {
+		attached[i] = stream.ReadCloser
 	}
+	k8s.attached[podKey(pod)] = attached
+	k8s.m.Unlock()
 
-	return logs, nil
+	for _, stream := range podStreams {
+		streams <- stream
+	}
 }
 
-func (k8s *Kubernetes) DeploymentPods(deploymentName string) []string {
-	replicasetsNames := []string{}
+// restarted shows the logs of the previous containers of an updated pod, for the containers that restarted.
+func (k8s *Kubernetes) restarted(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
 
-	for name, replicaset := range k8s.replicasets {
-		refs := replicaset.GetObjectMeta().GetOwnerReferences()
-		for _, ref := range refs {
-			if ref.Kind != "Deployment" {
-				continue
-			}
-			if ref.Name != deploymentName {
-				continue
+	k8s.m.Lock()
+	attached := k8s.attached[podKey(pod)]
+	k8s.m.Unlock()
+
+	for _, stream := range attached {
+		if s, ok := stream.(*podStream); ok {
+			s.restarted(pod)
+		}
+	}
+}
+
+func (k8s *Kubernetes) detach(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	k8s.m.Lock()
+	attached := k8s.attached[podKey(pod)]
+	delete(k8s.attached, podKey(pod))
+	k8s.m.Unlock()
+
+	for _, stream := range attached {
+		_ = stream.Close()
+	}
+}
+
+func podKey(pod *v1.Pod) string {
+	return pod.GetNamespace() + "/" + pod.GetName()
+}
+
+func containsPod(pods []*v1.Pod, podName string) bool {
+	for _, pod := range pods {
+		if pod.GetName() == podName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func podStarted(pod *v1.Pod) bool {
+	switch pod.Status.Phase {
+	case v1.PodRunning, v1.PodSucceeded, v1.PodFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// match reports whether the logs of the pod are streamed. For the pods of a workload, the container set for the
+// workload in the containers override is set for the pod, so match is only called when listing the pods and from
+// the pod informer, which are the only users of the containers override.
+func (k8s *Kubernetes) match(pod *v1.Pod) bool {
+	ok, w := k8s.selected(pod)
+	if ok && w != nil {
+		if container, found := k8s.containersOverride.Match(w.kind + "/" + w.name); found {
+			k8s.containersOverride.TryAdd("pod/"+podKey(pod), container)
+		}
+	}
+
+	return ok
+}
+
+// selected reports whether the pod is one of the pods streamed, with the workload it was selected through if
+// any. Unlike match, it has no side effect and can be called from the events informer.
+func (k8s *Kubernetes) selected(pod *v1.Pod) (bool, *workload) {
+	if contains(k8s.podNames, pod.GetName()) {
+		return true, nil
+	}
+
+	for i, w := range k8s.workloads {
+		if k8s.ownedBy(pod, w) {
+			return true, &k8s.workloads[i]
+		}
+	}
+
+	for _, selector := range k8s.selectors {
+		if selector.Matches(labels.Set(pod.GetLabels())) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (k8s *Kubernetes) PodLogs(pod *v1.Pod) ([]Stream, error) {
+	containers := k8s.podContainers(pod)
+	streams := make([]Stream, 0, len(containers))
+
+	for _, container := range containers {
+		stream, err := k8s.ContainerLogs(pod, container)
+		if err != nil {
+			for _, stream := range streams {
+				_ = stream.Close()
 			}
+			return nil, fmt.Errorf("container %q: %w", container, err)
+		}
+		streams = append(streams, stream)
+	}
+
+	return streams, nil
+}
+
+func (k8s *Kubernetes) ContainerLogs(pod *v1.Pod, container string) (Stream, error) {
+	logs, err := k8s.openLogs(pod.GetNamespace(), pod.GetName(), k8s.logOptions(container, nil))
+	if err != nil {
+		return Stream{}, err
+	}
+	if k8s.follow {
+		logs = newPodStream(k8s, pod, container, logs)
+	}
+
+	return Stream{
+		ReadCloser: logs,
+		Fields: map[string]interface{}{
+			"_source":    "kubernetes",
+			"_context":   k8s.context,
+			"_namespace": pod.GetNamespace(),
+			"_pod":       pod.GetName(),
+			"_container": container,
+		},
+	}, nil
+}
+
+// podContainers lists the containers to stream logs from. A container set in the containers override
+// takes precedence over -all-containers, the container of a pod over the one of its workload.
+func (k8s *Kubernetes) podContainers(pod *v1.Pod) []string {
+	if container, ok := k8s.containersOverride.Match("pod/" + pod.GetName()); ok {
+		return []string{container}
+	}
+	// the keys added for the pods of workloads include the namespace, for pods with the same name in different
+	// namespaces
+	if container, ok := k8s.containersOverride["pod/"+podKey(pod)]; ok {
+		return []string{container}
+	}
 
-			replicasetsNames = append(replicasetsNames, name)
-			break
+	if !k8s.allContainers {
+		if len(pod.Spec.Containers) == 1 {
+			return []string{pod.Spec.Containers[0].Name}
 		}
+		return []string{""} // default container
+	}
+
+	containers := make([]string, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	if k8s.initContainers {
+		for _, container := range pod.Spec.InitContainers {
+			if k8s.containerSelected(container.Name) {
+				containers = append(containers, container.Name)
+			}
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		if k8s.containerSelected(container.Name) {
+			containers = append(containers, container.Name)
+		}
+	}
+
+	return containers
+}
+
+func (k8s *Kubernetes) containerSelected(name string) bool {
+	if len(k8s.includeContainers) != 0 && !matchAny(k8s.includeContainers, name) {
+		return false
 	}
 
-	podsNames := []string{}
-	for name, pod := range k8s.pods {
-		refs := pod.GetObjectMeta().GetOwnerReferences()
+	return !matchAny(k8s.excludeContainers, name)
+}
+
+func (k8s *Kubernetes) logOptions(container string, sinceTime *metav1.Time) *v1.PodLogOptions {
+	opts := &v1.PodLogOptions{
+		Container:  container,
+		Follow:     k8s.follow,
+		Previous:   k8s.previous,
+		Timestamps: k8s.follow,
+	}
+	if sinceTime != nil {
+		opts.SinceTime = sinceTime
+		return opts
+	}
+
+	if k8s.since > 0 {
+		opts.SinceSeconds = new(int64)
+		*opts.SinceSeconds = int64(k8s.since / time.Second)
+	}
+	if k8s.tail >= 0 {
+		tail := k8s.tail
+		opts.TailLines = &tail
+	}
+
+	return opts
+}
+
+func (k8s *Kubernetes) clientsetLogs(namespace, podName string, opts *v1.PodLogOptions) (io.ReadCloser, error) {
+	pods := k8s.clientset.CoreV1().Pods(namespace)
+	req := pods.GetLogs(podName, opts).Timeout(0)
+
+	return req.Stream()
+}
+
+func (k8s *Kubernetes) ownedBy(pod *v1.Pod, w workload) bool {
+	kinds := workloadOwners[w.kind]
+	refs := pod.GetOwnerReferences()
+
+	for i, kind := range kinds {
+		last := i == len(kinds)-1
+		var next []metav1.OwnerReference
+
 		for _, ref := range refs {
-			if ref.Kind != "ReplicaSet" {
+			if ref.Kind != kind {
 				continue
 			}
-			if !contains(replicasetsNames, ref.Name) {
-				continue
+			if last && ref.Name == w.name {
+				return true
 			}
-
-			if container, ok := k8s.containersOverride.Match("deploy/" + deploymentName); ok {
-				k8s.containersOverride.TryAdd("pod/"+name, container)
+			if !last {
+				next = append(next, k8s.owners(pod.GetNamespace(), kind, ref.Name)...)
 			}
-			podsNames = append(podsNames, name)
-			break
 		}
+		refs = next
 	}
 
-	return podsNames
+	return false
 }
 
-func (k8s *Kubernetes) LabelSelectorPods(selector string) ([]string, error) {
-	pods, err := k8s.clientset.CoreV1().Pods(k8s.namespace).List(metav1.ListOptions{
-		LabelSelector: selector,
-	})
-	if err != nil {
-		return nil, err
+func (k8s *Kubernetes) owners(namespace, kind, name string) []metav1.OwnerReference {
+	switch {
+	case kind == "ReplicaSet" && k8s.replicasets != nil:
+		replicaset, err := k8s.replicasets.ReplicaSets(namespace).Get(name)
+		if err != nil {
+			return nil
+		}
+		return replicaset.GetOwnerReferences()
+	case kind == "Job" && k8s.jobs != nil:
+		job, err := k8s.jobs.Jobs(namespace).Get(name)
+		if err != nil {
+			return nil
+		}
+		return job.GetOwnerReferences()
+	default:
+		return nil
 	}
+}
 
-	podsNames := []string{}
-	for _, pod := range pods.Items {
-		podsNames = append(podsNames, pod.GetName())
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
 	}
 
-	return podsNames, nil
+	return false
 }
 
 func contains(ss []string, needle string) bool {
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EventsStream returns a stream of the events involving the pods and workloads being streamed, or every event of
+// the namespace if there are none. The events already in the cache are filtered with -since and -tail. In follow
+// mode, the events are then written as they are created or updated until stop is closed.
+func (k8s *Kubernetes) EventsStream(informer coreinformers.EventInformer, stop <-chan struct{}) (Stream, error) {
+	r, w := io.Pipe()
+	stream := Stream{
+		ReadCloser: r,
+		Fields: map[string]interface{}{
+			"_source":    "kubernetes-events",
+			"_context":   k8s.context,
+			"_namespace": k8s.namespace,
+		},
+	}
+
+	cached, err := informer.Lister().Events(k8s.namespace).List(labels.Everything())
+	if err != nil {
+		return Stream{}, err
+	}
+	events := k8s.tailEvents(cached)
+
+	if !k8s.follow {
+		go func() {
+			enc := json.NewEncoder(w)
+			for _, event := range events {
+				if err := enc.Encode(k8s.eventEntry(event)); err != nil {
+					return
+				}
+			}
+			_ = w.Close()
+		}()
+
+		return stream, nil
+	}
+
+	// the handler is first called with every event of the cache, the events listed above are skipped unless they
+	// changed since
+	listed := make(map[types.UID]string, len(cached))
+	for _, event := range cached {
+		listed[event.UID] = event.ResourceVersion
+	}
+
+	m := &sync.Mutex{}
+	enc := json.NewEncoder(w)
+	write := func(obj interface{}) {
+		event, ok := obj.(*v1.Event)
+		if !ok || !k8s.matchEvent(event) {
+			return
+		}
+
+		m.Lock()
+		defer m.Unlock()
+		_ = enc.Encode(k8s.eventEntry(event))
+	}
+
+	go func() {
+		m.Lock()
+		for _, event := range events {
+			if err := enc.Encode(k8s.eventEntry(event)); err != nil {
+				break
+			}
+		}
+		m.Unlock()
+
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if event, ok := obj.(*v1.Event); ok && listed[event.UID] == event.ResourceVersion {
+					delete(listed, event.UID)
+					return
+				}
+				write(obj)
+			},
+			UpdateFunc: func(old, obj interface{}) {
+				oldEvent, ok := old.(*v1.Event)
+				event, ok2 := obj.(*v1.Event)
+				if ok && ok2 && oldEvent.Count == event.Count && eventTime(oldEvent).Equal(eventTime(event)) {
+					return
+				}
+				write(obj)
+			},
+		})
+	}()
+
+	go func() {
+		<-stop
+		_ = w.CloseWithError(errStreamDetached)
+	}()
+
+	return stream, nil
+}
+
+// tailEvents returns the last -tail events matching, in chronological order.
+func (k8s *Kubernetes) tailEvents(cached []*v1.Event) []*v1.Event {
+	events := []*v1.Event{}
+	for _, event := range cached {
+		if k8s.matchEvent(event) {
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(events[i]).Before(eventTime(events[j]))
+	})
+
+	if k8s.tail >= 0 && int64(len(events)) > k8s.tail {
+		events = events[int64(len(events))-k8s.tail:]
+	}
+
+	return events
+}
+
+// matchEvent reports whether the event involves a pod or workload being streamed. Events involving other
+// objects (nodes, services, ...) are only kept when streaming every event of the namespace.
+func (k8s *Kubernetes) matchEvent(event *v1.Event) bool {
+	if k8s.since > 0 && time.Since(eventTime(event)) > k8s.since {
+		return false
+	}
+	if len(k8s.podNames) == 0 && len(k8s.workloads) == 0 && len(k8s.selectors) == 0 {
+		return true
+	}
+
+	obj := event.InvolvedObject
+	if obj.Kind == "Pod" {
+		pod, err := k8s.pods.Pods(obj.Namespace).Get(obj.Name)
+		if err != nil {
+			return contains(k8s.podNames, obj.Name)
+		}
+		ok, _ := k8s.selected(pod)
+		return ok
+	}
+
+	for _, w := range k8s.workloads {
+		kinds := workloadOwners[w.kind]
+		if obj.Kind == kinds[len(kinds)-1] && obj.Name == w.name {
+			return true
+		}
+		if len(kinds) > 1 && obj.Kind == kinds[0] {
+			for _, ref := range k8s.owners(obj.Namespace, obj.Kind, obj.Name) {
+				if ref.Kind == kinds[1] && ref.Name == w.name {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func (k8s *Kubernetes) eventEntry(event *v1.Event) map[string]interface{} {
+	level := "info"
+	if event.Type == v1.EventTypeWarning {
+		level = "warning"
+	}
+
+	entry := map[string]interface{}{
+		"time":      eventTime(event),
+		"level":     level,
+		"msg":       event.Message,
+		"type":      event.Type,
+		"reason":    event.Reason,
+		"kind":      event.InvolvedObject.Kind,
+		"object":    event.InvolvedObject.Name,
+		"namespace": event.InvolvedObject.Namespace,
+		"count":     event.Count,
+	}
+	if event.InvolvedObject.FieldPath != "" {
+		entry["field_path"] = event.InvolvedObject.FieldPath
+	}
+	if event.Source.Component != "" {
+		entry["component"] = event.Source.Component
+	}
+	if event.Source.Host != "" {
+		entry["host"] = event.Source.Host
+	}
+	if !event.FirstTimestamp.IsZero() {
+		entry["first_seen"] = event.FirstTimestamp.Time
+	}
+
+	return entry
+}
+
+// eventTime returns the last time the event occurred.
+func eventTime(event *v1.Event) time.Time {
+	switch {
+	case event.Series != nil && !event.Series.LastObservedTime.IsZero():
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	case !event.FirstTimestamp.IsZero():
+		return event.FirstTimestamp.Time
+	default:
+		return event.GetCreationTimestamp().Time
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+type kubernetesSource struct {
+	field    func(*Config) *[]string
+	selector bool
+}
+
+var kubernetesSources = []kubernetesSource{
+	{field: func(c *Config) *[]string { return &c.Pods }},
+	{field: func(c *Config) *[]string { return &c.Deployments }},
+	{field: func(c *Config) *[]string { return &c.StatefulSets }},
+	{field: func(c *Config) *[]string { return &c.DaemonSets }},
+	{field: func(c *Config) *[]string { return &c.Jobs }},
+	{field: func(c *Config) *[]string { return &c.CronJobs }},
+	{field: func(c *Config) *[]string { return &c.Labels }, selector: true},
+}
+
+type contextNamespace struct {
+	context   string
+	namespace string
+}
+
+// KubernetesConfigs splits the Kubernetes sources by their 'context/namespace/' prefix, returning a
+// configuration for each context and namespace, in the order they first appear. With -events and no Kubernetes
+// sources, the events of the default namespace are streamed.
+func KubernetesConfigs(conf Config) []Config {
+	confs := []Config{}
+	indexes := map[contextNamespace]int{}
+
+	for _, source := range kubernetesSources {
+		for _, s := range *source.field(&conf) {
+			prefix, name := splitSourcePrefix(s, source.selector)
+
+			i, ok := indexes[prefix]
+			if !ok {
+				i = len(confs)
+				indexes[prefix] = i
+				confs = append(confs, kubernetesConfig(conf, prefix))
+			}
+			field := source.field(&confs[i])
+			*field = append(*field, name)
+		}
+	}
+
+	if len(confs) == 0 && conf.Events {
+		confs = append(confs, kubernetesConfig(conf, contextNamespace{}))
+	}
+
+	return confs
+}
+
+func kubernetesConfig(conf Config, prefix contextNamespace) Config {
+	c := conf
+	for _, source := range kubernetesSources {
+		*source.field(&c) = nil
+	}
+
+	if prefix.context != "" {
+		c.Context = prefix.context
+	}
+	if prefix.namespace != "" {
+		c.Namespace = prefix.namespace
+		c.AllNamespaces = false
+	}
+
+	c.Containers = ConfigMap{}
+	for k, v := range conf.Containers {
+		c.Containers[k] = v
+	}
+
+	return c
+}
+
+// splitSourcePrefix splits a source in the form 'context/namespace/name'. Since label selectors can contain
+// slashes, a prefix is only recognized on selectors if the namespace is a valid namespace name and the context
+// does not contain any of the selector operators.
+func splitSourcePrefix(s string, selector bool) (contextNamespace, string) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 {
+		return contextNamespace{}, s
+	}
+
+	prefix := contextNamespace{
+		context:   parts[0],
+		namespace: parts[1],
+	}
+	if !selector {
+		return prefix, parts[2]
+	}
+
+	if prefix.namespace != "" && len(validation.IsDNS1123Label(prefix.namespace)) != 0 {
+		return contextNamespace{}, s
+	}
+	if strings.ContainsAny(prefix.context, "=!, ()") {
+		return contextNamespace{}, s
+	}
+
+	return prefix, parts[2]
+}
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "default"
+
+func init() {
+	ReconnectMinBackoff = 10 * time.Millisecond
+}
+
+func testPod(name string, phase v1.PodPhase, labels map[string]string, owner *metav1.OwnerReference, containers ...string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    labels,
+		},
+		Status: v1.PodStatus{
+			Phase: phase,
+		},
+	}
+	if owner != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	for _, container := range containers {
+		if strings.HasPrefix(container, "init:") {
+			pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{Name: strings.TrimPrefix(container, "init:")})
+			continue
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: container})
+	}
+
+	return pod
+}
+
+func ownerRef(kind, name string) *metav1.OwnerReference {
+	return &metav1.OwnerReference{
+		Kind: kind,
+		Name: name,
+	}
+}
+
+func testObjects() []runtime.Object {
+	return []runtime.Object{
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "api-6f7b",
+				Namespace:       testNamespace,
+				OwnerReferences: []metav1.OwnerReference{*ownerRef("Deployment", "api")},
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "backup-1600000000",
+				Namespace:       testNamespace,
+				OwnerReferences: []metav1.OwnerReference{*ownerRef("CronJob", "backup")},
+			},
+		},
+		testPod("api-6f7b-a", v1.PodRunning, map[string]string{"app": "api"}, ownerRef("ReplicaSet", "api-6f7b"), "api", "envoy"),
+		testPod("db-0", v1.PodRunning, map[string]string{"app": "db"}, ownerRef("StatefulSet", "db"), "init:migrate", "postgres"),
+		testPod("agent-x1", v1.PodRunning, map[string]string{"app": "agent"}, ownerRef("DaemonSet", "agent"), "agent"),
+		testPod("backup-1600000000-q", v1.PodSucceeded, nil, ownerRef("Job", "backup-1600000000"), "backup"),
+		testPod("debug", v1.PodRunning, map[string]string{"app": "debug"}, nil, "shell"),
+	}
+}
+
+// blockingLogs is an empty logs stream that only ends once closed, like the logs of a running container.
+type blockingLogs struct {
+	done chan struct{}
+	once *sync.Once
+}
+
+func (l blockingLogs) Read([]byte) (int, error) {
+	<-l.done
+	return 0, io.EOF
+}
+
+func (l blockingLogs) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+// testKubernetes returns a Kubernetes source on a fake clientset, whose logs streams are empty and, when
+// following, never end.
+func testKubernetes(t *testing.T, conf Config, objects ...runtime.Object) (*Kubernetes, *fake.Clientset) {
+	t.Helper()
+
+	clientset := fake.NewSimpleClientset(objects...)
+	k8s, err := newKubernetes(clientset, "test", testNamespace, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k8s.openLogs = func(_, _ string, opts *v1.PodLogOptions) (io.ReadCloser, error) {
+		if opts.Follow {
+			return blockingLogs{done: make(chan struct{}), once: &sync.Once{}}, nil
+		}
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+
+	return k8s, clientset
+}
+
+func streamKey(stream Stream) string {
+	return stream.Fields["_pod"].(string) + "/" + stream.Fields["_container"].(string)
+}
+
+func TestStreamSelection(t *testing.T) {
+	tests := []struct {
+		name string
+		conf Config
+		want []string
+	}{
+		{
+			name: "pod",
+			conf: Config{Pods: []string{"debug"}},
+			want: []string{"debug/shell"},
+		},
+		{
+			name: "deployment",
+			conf: Config{Deployments: []string{"api"}},
+			want: []string{"api-6f7b-a/"},
+		},
+		{
+			name: "statefulset and daemonset",
+			conf: Config{StatefulSets: []string{"db"}, DaemonSets: []string{"agent"}},
+			want: []string{"agent-x1/agent", "db-0/postgres"},
+		},
+		{
+			name: "cronjob",
+			conf: Config{CronJobs: []string{"backup"}},
+			want: []string{"backup-1600000000-q/backup"},
+		},
+		{
+			name: "job",
+			conf: Config{Jobs: []string{"backup-1600000000"}},
+			want: []string{"backup-1600000000-q/backup"},
+		},
+		{
+			name: "selector",
+			conf: Config{Labels: []string{"app in (api, db)"}},
+			want: []string{"api-6f7b-a/", "db-0/postgres"},
+		},
+		{
+			name: "all containers",
+			conf: Config{Deployments: []string{"api"}, AllContainers: true},
+			want: []string{"api-6f7b-a/api", "api-6f7b-a/envoy"},
+		},
+		{
+			name: "excluded containers",
+			conf: Config{Deployments: []string{"api"}, ExcludeContainers: []string{"env*"}},
+			want: []string{"api-6f7b-a/api"},
+		},
+		{
+			name: "included containers",
+			conf: Config{Labels: []string{"app"}, IncludeContainers: []string{"a*"}},
+			want: []string{"agent-x1/agent", "api-6f7b-a/api"},
+		},
+		{
+			name: "init containers",
+			conf: Config{StatefulSets: []string{"db"}, InitContainers: true},
+			want: []string{"db-0/migrate", "db-0/postgres"},
+		},
+		{
+			name: "containers override",
+			conf: Config{Deployments: []string{"api"}, Containers: ConfigMap{"deploy/ap*": "envoy"}},
+			want: []string{"api-6f7b-a/envoy"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf.Tail = -1
+			k8s, _ := testKubernetes(t, test.conf, testObjects()...)
+
+			stop := make(chan struct{})
+			defer close(stop)
+			streams := make(chan Stream, 10)
+			err := k8s.Stream(streams, stop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			close(streams)
+
+			got := []string{}
+			for stream := range streams {
+				got = append(got, streamKey(stream))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("streams = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamContainersOverrideAllNamespaces(t *testing.T) {
+	conf := Config{
+		Deployments:   []string{"api"},
+		Labels:        []string{"app=api"},
+		AllNamespaces: true,
+		Containers:    ConfigMap{"deploy/api": "envoy"},
+		Tail:          -1,
+	}
+	// a pod with the same name in another namespace, not owned by the deployment
+	other := testPod("api-6f7b-a", v1.PodRunning, map[string]string{"app": "api"}, nil, "api", "envoy")
+	other.Namespace = "staging"
+	k8s, _ := testKubernetes(t, conf, append(testObjects(), other)...)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	streams := make(chan Stream, 10)
+	err := k8s.Stream(streams, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(streams)
+
+	got := []string{}
+	for stream := range streams {
+		got = append(got, stream.Fields["_namespace"].(string)+"/"+streamKey(stream))
+	}
+	sort.Strings(got)
+	if want := []string{"default/api-6f7b-a/envoy", "staging/api-6f7b-a/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("streams = %v, want %v", got, want)
+	}
+}
+
+func TestStreamMissingPod(t *testing.T) {
+	k8s, _ := testKubernetes(t, Config{Pods: []string{"missing"}, Tail: -1}, testObjects()...)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	err := k8s.Stream(make(chan Stream, 10), stop)
+	if err == nil {
+		t.Fatal("expected an error for a missing pod")
+	}
+}
+
+func receiveStream(t *testing.T, streams <-chan Stream) Stream {
+	t.Helper()
+
+	select {
+	case stream := <-streams:
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a stream")
+		return Stream{}
+	}
+}
+
+func TestStreamFollowsPods(t *testing.T) {
+	k8s, clientset := testKubernetes(t, Config{Deployments: []string{"api"}, Follow: true, Tail: -1}, testObjects()...)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	streams := make(chan Stream)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- k8s.Stream(streams, stop)
+	}()
+
+	first := receiveStream(t, streams)
+	if got := streamKey(first); got != "api-6f7b-a/" {
+		t.Fatalf("first stream = %q, want %q", got, "api-6f7b-a/")
+	}
+
+	pods := clientset.CoreV1().Pods(testNamespace)
+	_, err := pods.Create(testPod("api-6f7b-b", v1.PodPending, nil, ownerRef("ReplicaSet", "api-6f7b"), "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pods.Create(testPod("other", v1.PodRunning, nil, nil, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pods.Update(testPod("api-6f7b-b", v1.PodRunning, nil, ownerRef("ReplicaSet", "api-6f7b"), "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := receiveStream(t, streams)
+	if got := streamKey(second); got != "api-6f7b-b/api" {
+		t.Fatalf("second stream = %q, want %q", got, "api-6f7b-b/api")
+	}
+
+	err = pods.Delete("api-6f7b-a", &metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	detached := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(first)
+		detached <- err
+	}()
+	select {
+	case err := <-detached:
+		if err != errStreamDetached {
+			t.Errorf("deleted pod stream ended with %v, want %v", err, errStreamDetached)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the deleted pod stream to be detached")
+	}
+
+	select {
+	case stream := <-streams:
+		t.Errorf("unexpected stream %q", streamKey(stream))
+	case err := <-errs:
+		t.Errorf("Stream returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStreamListsOnlyNeededOwners(t *testing.T) {
+	tests := []struct {
+		name string
+		conf Config
+		want []string
+	}{
+		{
+			name: "job",
+			conf: Config{Jobs: []string{"backup-1600000000"}},
+			want: []string{"pods"},
+		},
+		{
+			name: "cronjob",
+			conf: Config{CronJobs: []string{"backup"}},
+			want: []string{"jobs", "pods"},
+		},
+		{
+			name: "deployment",
+			conf: Config{Deployments: []string{"api"}},
+			want: []string{"pods", "replicasets"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf.Tail = -1
+			k8s, clientset := testKubernetes(t, test.conf, testObjects()...)
+
+			stop := make(chan struct{})
+			defer close(stop)
+			err := k8s.Stream(make(chan Stream, 10), stop)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listed := map[string]bool{}
+			for _, action := range clientset.Actions() {
+				if action.GetVerb() == "list" {
+					listed[action.GetResource().Resource] = true
+				}
+			}
+			got := []string{}
+			for resource := range listed {
+				got = append(got, resource)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("listed %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func testEvent(name, reason string, at time.Time) *v1.Event {
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       testNamespace,
+			UID:             types.UID(name),
+			ResourceVersion: "1",
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:      "Pod",
+			Name:      "debug",
+			Namespace: testNamespace,
+		},
+		Reason:        reason,
+		Message:       reason,
+		Type:          v1.EventTypeNormal,
+		Count:         1,
+		LastTimestamp: metav1.NewTime(at),
+	}
+}
+
+func TestEventsStreamFollow(t *testing.T) {
+	now := time.Now()
+	objects := append(testObjects(),
+		testEvent("pulled", "Pulled", now.Add(-3*time.Hour)),
+		testEvent("created", "Created", now.Add(-2*time.Minute)),
+		testEvent("started", "Started", now.Add(-time.Minute)),
+	)
+	k8s, clientset := testKubernetes(t, Config{Pods: []string{"debug"}, Events: true, Follow: true, Tail: 2}, objects...)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	streams := make(chan Stream, 10)
+	go func() {
+		_ = k8s.Stream(streams, stop)
+	}()
+
+	stream := receiveStream(t, streams)
+	if stream.Fields["_source"] != "kubernetes-events" {
+		t.Fatalf("first stream of %v, want the events", stream.Fields["_source"])
+	}
+
+	reasons := make(chan string, 10)
+	go func() {
+		dec := json.NewDecoder(stream)
+		for {
+			var entry struct {
+				Reason string
+			}
+			if dec.Decode(&entry) != nil {
+				return
+			}
+			reasons <- entry.Reason
+		}
+	}()
+
+	// the cached events are listed first, the informer handler must not write them again
+	_, err := clientset.CoreV1().Events(testNamespace).Create(testEvent("killing", "Killing", now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for len(got) < 3 {
+		select {
+		case reason := <-reasons:
+			got = append(got, reason)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for events, got %v", got)
+		}
+	}
+	if want := []string{"Created", "Started", "Killing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	select {
+	case reason := <-reasons:
+		t.Errorf("unexpected event %q", reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventsStreamConcurrentPods(t *testing.T) {
+	conf := Config{
+		Deployments: []string{"api"},
+		Containers:  ConfigMap{"deploy/api": "envoy"},
+		Events:      true,
+		Follow:      true,
+		Tail:        -1,
+	}
+	const n = 20
+	apiPod := func(i int) *v1.Pod {
+		return testPod(fmt.Sprintf("api-6f7b-%d", i), v1.PodRunning, nil, ownerRef("ReplicaSet", "api-6f7b"), "api", "envoy")
+	}
+	objects := testObjects()
+	for i := 0; i < n; i++ {
+		objects = append(objects, apiPod(i))
+	}
+	k8s, clientset := testKubernetes(t, conf, objects...)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	streams := make(chan Stream)
+	go func() {
+		_ = k8s.Stream(streams, stop)
+	}()
+
+	events := receiveStream(t, streams)
+	if events.Fields["_source"] != "kubernetes-events" {
+		t.Fatalf("first stream of %v, want the events", events.Fields["_source"])
+	}
+	eventsRead := make(chan int)
+	go func() {
+		read := 0
+		dec := json.NewDecoder(events)
+		for dec.Decode(&map[string]interface{}{}) == nil {
+			read++
+			eventsRead <- read
+		}
+	}()
+
+	// the events of the pods are matched by the events informer while the pod informer attaches the pods, both
+	// the existing ones and the ones created
+	errs := make(chan error, 2)
+	go func() {
+		for i := n; i < 2*n; i++ {
+			if _, err := clientset.CoreV1().Pods(testNamespace).Create(apiPod(i)); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for i := 0; i < n; i++ {
+			event := testEvent(fmt.Sprintf("started-%d", i), "Started", time.Now())
+			event.InvolvedObject.Name = fmt.Sprintf("api-6f7b-%d", i)
+			if _, err := clientset.CoreV1().Events(testNamespace).Create(event); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// api-6f7b-a and the pods added
+	attached, read := 0, 0
+	for attached < 2*n+1 || read < n {
+		select {
+		case stream := <-streams:
+			if got := stream.Fields["_container"]; got != "envoy" {
+				t.Errorf("stream of container %q, want envoy", got)
+			}
+			attached++
+		case read = <-eventsRead:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out with %d pods attached and %d events read", attached, read)
+		}
+	}
+}
+
+// restartingLogs serves the logs of a container restarting once: the first logs stream ends with the previous
+// container, the next ones follow the new container.
+type restartingLogs struct {
+	previous string
+	current  []string
+	calls    int
+	m        sync.Mutex
+
+	previousCalls int
+}
+
+func (l *restartingLogs) open(_, _ string, opts *v1.PodLogOptions) (io.ReadCloser, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if opts.Previous {
+		l.previousCalls++
+		return ioutil.NopCloser(strings.NewReader(l.previous)), nil
+	}
+
+	l.calls++
+	if l.calls == 1 {
+		return ioutil.NopCloser(strings.NewReader(l.current[0])), nil
+	}
+	logs := blockingLogs{done: make(chan struct{}), once: &sync.Once{}}
+	if l.calls > len(l.current) {
+		return logs, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(strings.NewReader(l.current[l.calls-1]), logs), logs}, nil
+}
+
+func restartedPod(restarts int32, started time.Time) *v1.Pod {
+	pod := testPod("debug", v1.PodRunning, nil, nil, "shell")
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{
+		Name:         "shell",
+		RestartCount: restarts,
+		State: v1.ContainerState{
+			Running: &v1.ContainerStateRunning{StartedAt: metav1.NewTime(started)},
+		},
+	}}
+
+	return pod
+}
+
+func TestPodStreamRestart(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) string {
+		return start.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339Nano)
+	}
+	logs := &restartingLogs{
+		// the previous container's last line was not streamed before it ended
+		previous: at(1) + " {\"msg\":\"a\"}\n" + at(2) + " {\"msg\":\"b\"}\n" + at(3) + " {\"msg\":\"c\"}\n",
+		current: []string{
+			at(1) + " {\"msg\":\"a\"}\n" + at(2) + " {\"msg\":\"b\"}\n",
+			at(5) + " {\"msg\":\"new\"}\n",
+		},
+	}
+	k8s, clientset := testKubernetes(t, Config{Pods: []string{"debug"}, Follow: true, Tail: -1, RestartTail: 10}, restartedPod(0, start))
+	k8s.openLogs = logs.open
+
+	stop := make(chan struct{})
+	defer close(stop)
+	streams := make(chan Stream, 10)
+	go func() {
+		_ = k8s.Stream(streams, stop)
+	}()
+	stream := receiveStream(t, streams)
+
+	type line struct {
+		Msg          string
+		Level        string
+		Previous     bool  `json:"_previous"`
+		RestartCount int32 `json:"_restart_count"`
+	}
+	lines := make(chan line, 10)
+	go func() {
+		dec := json.NewDecoder(stream)
+		for {
+			var l line
+			if dec.Decode(&l) != nil {
+				return
+			}
+			if l.Level != "trace" {
+				lines <- l
+			}
+		}
+	}()
+	receive := func() line {
+		t.Helper()
+		select {
+		case l := <-lines:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a line")
+			return line{}
+		}
+	}
+
+	got := []line{receive(), receive(), receive()}
+	if want := []line{{Msg: "a"}, {Msg: "b"}, {Msg: "new"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("lines = %+v, want %+v", got, want)
+	}
+
+	// the restart is only seen once the new container's lines were written
+	pods := clientset.CoreV1().Pods(testNamespace)
+	for i := 0; i < 2; i++ {
+		_, err := pods.Update(restartedPod(1, start.Add(4*time.Second)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := receive(), (line{Msg: "c", Previous: true, RestartCount: 0}); got != want {
+		t.Errorf("previous container line = %+v, want %+v", got, want)
+	}
+	select {
+	case l := <-lines:
+		t.Errorf("unexpected line %+v", l)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	logs.m.Lock()
+	defer logs.m.Unlock()
+	if logs.previousCalls != 1 {
+		t.Errorf("previous container logs fetched %d times, want once", logs.previousCalls)
+	}
+}
+
+// reconnectingLogs serves logs streams that end after their lines, the last one never ending. Like the API
+// server, each stream starts with the lines at the SinceTime it was opened with.
+type reconnectingLogs struct {
+	streams []string
+	since   []*metav1.Time
+	m       sync.Mutex
+}
+
+func (l *reconnectingLogs) open(_, _ string, opts *v1.PodLogOptions) (io.ReadCloser, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.since = append(l.since, opts.SinceTime)
+	if len(l.since) > len(l.streams) {
+		return blockingLogs{done: make(chan struct{}), once: &sync.Once{}}, nil
+	}
+
+	return ioutil.NopCloser(strings.NewReader(l.streams[len(l.since)-1])), nil
+}
+
+func TestPodStreamReconnect(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) string {
+		return start.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339Nano)
+	}
+	logs := &reconnectingLogs{
+		streams: []string{
+			at(1) + " a\n" + at(2) + " b\n" + at(2) + " b\n",
+			// resumed from the last timestamp: the lines at 2s were already written, except the second "c"
+			at(2) + " b\n" + at(2) + " b\n" + at(2) + " c\n" + at(3) + " d\n",
+			at(3) + " d\n" + at(3) + " d\n" + at(4) + " e\n",
+		},
+	}
+	k8s, _ := testKubernetes(t, Config{Pods: []string{"debug"}, Follow: true, Tail: -1}, testObjects()...)
+	k8s.openLogs = logs.open
+
+	stop := make(chan struct{})
+	defer close(stop)
+	streams := make(chan Stream, 10)
+	go func() {
+		_ = k8s.Stream(streams, stop)
+	}()
+	stream := receiveStream(t, streams)
+
+	lines := make(chan string, 10)
+	go func() {
+		r := bufio.NewReader(stream)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if !strings.Contains(line, `"level":"trace"`) {
+				lines <- strings.TrimSuffix(line, "\n")
+			}
+		}
+	}()
+
+	got := []string{}
+	for len(got) < 7 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %q", got)
+		}
+	}
+	if want := []string{"a", "b", "b", "c", "d", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+	select {
+	case line := <-lines:
+		t.Errorf("unexpected line %q", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	logs.m.Lock()
+	defer logs.m.Unlock()
+	since := []string{}
+	for _, s := range logs.since[:3] {
+		if s == nil {
+			since = append(since, "")
+			continue
+		}
+		since = append(since, s.UTC().Format(time.RFC3339Nano))
+	}
+	if want := []string{"", at(2), at(3)}; !reflect.DeepEqual(since, want) {
+		t.Errorf("streams opened since %q, want %q", since, want)
+	}
+}
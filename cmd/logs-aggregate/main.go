@@ -2,16 +2,23 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime/pprof"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Pimmr/logs-dashboard/internal/flags"
+	"github.com/Pimmr/logs-dashboard/internal/multiline"
+	"github.com/Pimmr/logs-dashboard/internal/normalize"
+	"github.com/Pimmr/logs-dashboard/internal/redact"
 	"github.com/Pimmr/rig"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
@@ -19,33 +26,82 @@ import (
 // TODO: use Config.Containers
 
 type Config struct {
-	Pods        []string `flag:"pod" usage:"stream logs from these pods"`
-	Deployments []string `flag:"deploy" usage:"stream logs from pods in these deployments"`
-	Labels      []string `flag:"label" usage:"stream logs from pods matching these selectors"`
-	Gcloud      []string `usage:"stream logs from these filters"`
-	Listen      string   `usage:"listen for logs streamed over HTTP"`
+	Pods             []string       `flag:"pod" usage:"stream logs from these pods.\n Kubernetes sources can be prefixed with 'context/namespace/' (either can be left empty to use the defaults)"`
+	Deployments      []string       `flag:"deploy" usage:"stream logs from pods in these deployments"`
+	StatefulSets     []string       `flag:"sts" usage:"stream logs from pods in these statefulsets"`
+	DaemonSets       []string       `flag:"ds" usage:"stream logs from pods in these daemonsets"`
+	Jobs             []string       `flag:"job" usage:"stream logs from pods in these jobs"`
+	CronJobs         []string       `flag:"cronjob" usage:"stream logs from pods in jobs spawned by these cronjobs"`
+	Labels           []string       `flag:"label" usage:"stream logs from pods matching these selectors"`
+	Events           bool           `usage:"stream the Kubernetes events involving the pods and workloads, or all the events of the namespace without Kubernetes sources.\n The events listed when starting are filtered with -since and -tail"`
+	Gcloud           []string       `usage:"stream logs from these filters"`
+	Listen           string         `usage:"listen for NDJSON logs POSTed over HTTP (optionally gzip-encoded, tagged with the X-Logs-Tag header or the tag query parameter).\n Bodies are limited to 16MiB, and their lines are only forwarded once the whole body is read"`
+	ListenToken      string         `usage:"bearer token required to POST logs over HTTP"`
+	ListenProxies    []string       `usage:"addresses or CIDR ranges of the proxies trusted to set X-Forwarded-For, used for the client address of the lines POSTed over HTTP with -tag"`
+	Syslog           []string       `usage:"listen for syslog messages (RFC 5424 or RFC 3164) on these addresses, over UDP and TCP unless prefixed with 'udp://' or 'tcp://'"`
+	Files            []string       `flag:"file" usage:"stream logs from the files matching these glob patterns, following truncation, rotation and new files with -follow"`
+	Exec             flags.Strings  `usage:"stream the stdout and stderr of these commands, run with the shell"`
+	ExecRestart      bool           `usage:"restart the -exec commands when they exit"`
+	Replay           []string       `usage:"replay these saved files (i.e. written with the dashboard's 's' key), following the delays between the times of their entries across all the files.\n SIGUSR1 pauses or resumes the replay, SIGUSR2 skips ahead by -replay-seek-step"`
+	ReplaySpeed      float64        `usage:"speed multiplier of the replay"`
+	ReplayMaxGap     time.Duration  `usage:"maximum delay between two replayed entries, before the speed multiplier (0 for no maximum)"`
+	ReplaySeek       time.Duration  `usage:"skip this far into the replay, writing the entries skipped right away"`
+	ReplaySeekStep   time.Duration  `usage:"how far ahead the replay skips on SIGUSR2"`
+	Filter           string         `usage:"only output the lines matching these jsonql queries separated by ';' (i.e. \"level = 'error'\").\n The queries can use the raw and _msg pseudo-fields, and the source fields (_source, _pod, ...).\n The lines are filtered once redacted"`
+	SourceFilter     SourceFilters  `usage:"only output the lines of the sources with a field matching a pattern if they match a query (i.e. \"_pod=api-*:level = 'error'\")"`
+	MessageKeys      []string       `usage:"message keys, used for the _msg pseudo-field"`
+	Format           string         `usage:"format of the lines, rewritten to the logrus keys (time, level, msg): auto, none, logrus, zap, zerolog, bunyan, ecs, gcp or logfmt.\n With auto the format is detected for each source, and logfmt lines are converted to JSON"`
+	Grok             flags.Strings  `usage:"convert the raw lines matching these patterns to JSON: grok expressions (i.e. '%{IP:client} %{INT:status:int}'), regexps with named groups,\n or built-in patterns (COMMONAPACHELOG, COMBINEDAPACHELOG, NGINXACCESS, ENVOYACCESS)"`
+	SourceGrok       SourcePatterns `usage:"convert the raw lines of the sources with a field matching a pattern with an extraction pattern (i.e. '_container=nginx:NGINXACCESS')"`
+	Multiline        []string       `usage:"join the lines of plain-text stack traces into the stacktrace field of the line before them: java, python or go"`
+	MultilineStart   *regexp.Regexp `usage:"join the lines not matching this regexp into the stacktrace field of the line before them"`
+	MultilineTimeout time.Duration  `usage:"how long to wait for more lines of a multi-line event"`
+	Redact           []string       `usage:"redact the values found by these detectors: jwt, email or card.\n The lines are redacted before being filtered and tagged"`
+	RedactFields     []string       `usage:"redact the values of the fields matching these patterns, ignoring case (i.e. '*password*', 'authorization' or 'user.email')"`
+	RedactValues     flags.Strings  `usage:"redact the parts of the values matching these regexps"`
+	RedactHash       bool           `usage:"replace the redacted values with a keyed hash of the value rather than a mask, so that entries can still be correlated"`
+	RedactHashKey    string         `usage:"key of the redaction hashes, required with -redact-hash"`
+	Order            time.Duration  `usage:"merge the streams in the order of their time field, holding lines up to this long for older lines to arrive.\n Lines arriving after newer lines were written are marked with _late"`
+	MetricsAddr      string         `usage:"serve metrics in the Prometheus text format on this address, under /metrics"`
+	Tag              bool           `usage:"add the source of each line as fields (_source, _namespace, _pod, _container, ...)"`
 
 	CPUProfile string
 
-	KubeConfig    string
-	Context       string `usage:"kubectl context"`
-	Namespace     string `usage:"kubectl namespace"`
-	Since         time.Duration
-	Tail          int64
-	Containers    ConfigMap `usage:"specify container for deployments and pods (i.e 'deploy/deploymentName:containerName' or 'pod/podName:containerName').\n The keys can use * and ? for pattern matching"`
-	GcloudProject string
-	GcloudPoll    time.Duration
-	Follow        bool
-	Previous      bool `usage:"show logs for previous pods"`
-	Pid           bool
+	KubeConfig        string
+	Context           string `usage:"kubectl context"`
+	Namespace         string `usage:"kubectl namespace"`
+	AllNamespaces     bool   `usage:"look for pods in all namespaces"`
+	Since             time.Duration
+	Tail              int64     `usage:"number of lines to show from the end of the logs (files are read from the end with -follow unless set)"`
+	Containers        ConfigMap `usage:"specify container for workloads and pods (i.e 'deploy/deploymentName:containerName', 'sts/statefulSetName:containerName' or 'pod/podName:containerName').\n Workloads can be deploy, sts, ds, job or cronjob. The keys can use * and ? for pattern matching, the most specific pattern wins"`
+	AllContainers     bool      `usage:"stream logs from all the containers of the pods"`
+	IncludeContainers []string  `usage:"only stream logs from the containers matching these patterns (implies -all-containers)"`
+	ExcludeContainers []string  `usage:"do not stream logs from the containers matching these patterns (implies -all-containers)"`
+	InitContainers    bool      `usage:"also stream logs from init containers (implies -all-containers)"`
+	GcloudProject     string    `usage:"default project for the gcloud filters (filters can be prefixed with 'project/')"`
+	GcloudPoll        time.Duration
+	GcloudOverlap     time.Duration `usage:"how far before the last entry seen each poll starts, to catch entries received late"`
+	GcloudEndpoint    string        `usage:"Cloud Logging API endpoint"`
+	Follow            bool
+	Previous          bool  `usage:"show logs for previous pods"`
+	RestartTail       int64 `usage:"number of lines to show from the logs of the previous container when a container restarts with -follow"`
+	Pid               bool
 }
 
 func main() {
 	conf := Config{
-		Tail: -1,
-
-		GcloudProject: "cally-re",
-		GcloudPoll:    5 * time.Second,
+		Tail:             -1,
+		RestartTail:      100,
+		MessageKeys:      []string{"msg", "message"},
+		Format:           string(normalize.Auto),
+		MultilineTimeout: time.Second,
+		ReplaySpeed:      1,
+		ReplaySeekStep:   time.Minute,
+
+		GcloudProject:  "cally-re",
+		GcloudPoll:     5 * time.Second,
+		GcloudOverlap:  10 * time.Second,
+		GcloudEndpoint: "https://logging.googleapis.com",
 	}
 
 	if home := homeDir(); home != "" {
@@ -63,6 +119,53 @@ func main() {
 		os.Exit(2)
 	}
 
+	format, err := normalize.ParseFormat(conf.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	trustedProxies, err := parseTrustedProxies(conf.ListenProxies)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	lineFilter, err := NewLineFilter(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	detectors, err := multiline.ParseDetectors(conf.Multiline)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	multilineConf := multiline.Config{
+		Start:     conf.MultilineStart,
+		Detectors: detectors,
+		Timeout:   conf.MultilineTimeout,
+	}
+
+	lineParser, err := NewLineParser(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	redactor, err := redact.New(redact.Config{
+		Fields:    conf.RedactFields,
+		Values:    conf.RedactValues,
+		Detectors: conf.Redact,
+		Hash:      conf.RedactHash,
+		HashKey:   conf.RedactHashKey,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
 	if conf.CPUProfile != "" {
 		pprofF, err := os.Create(conf.CPUProfile)
 		if err != nil {
@@ -80,49 +183,99 @@ func main() {
 		}()
 	}
 
-	k8s, err := NewKubernetes(conf)
-	exitIfError(err)
-
-	pods := make([]string, 0, len(conf.Pods)+len(conf.Deployments)+len(conf.Labels))
-	streams := make([]io.ReadCloser, 0, len(conf.Pods)+len(conf.Deployments)+len(conf.Labels))
-
-	pods = append(pods, conf.Pods...)
+	if conf.MetricsAddr != "" {
+		metrics = NewMetrics()
+		err := serveMetrics(conf.MetricsAddr, metrics)
+		exitIfError(err)
+	}
 
 	if conf.Pid {
 		logPid()
 	}
 
-	for _, deployment := range conf.Deployments {
-		deploymentPods := k8s.DeploymentPods(deployment)
+	stop := make(chan struct{})
+	defer close(stop)
+	defer StopCommands()
 
-		pods = append(pods, deploymentPods...)
+	if len(conf.Exec) != 0 {
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			StopCommands()
+			os.Exit(1)
+		}()
 	}
 
-	for _, label := range conf.Labels {
-		selectedPods, err := k8s.LabelSelectorPods(label)
-		exitIfError(err)
+	streams := make(chan Stream)
+	go func() {
+		defer close(streams)
 
-		pods = append(pods, selectedPods...)
-	}
+		for _, command := range conf.Exec {
+			execStreams, err := ExecStreams(command, conf.ExecRestart)
+			exitIfError(err)
+			for _, stream := range execStreams {
+				streams <- stream
+			}
+		}
 
-	for _, pod := range pods {
-		stream, err := k8s.PodLogs(pod)
-		exitIfError(err)
+		if len(conf.Replay) != 0 {
+			replayStreams, err := ReplayStreams(conf, stop)
+			exitIfError(err)
+			controlReplay(conf.ReplaySeekStep, stop)
+			for _, stream := range replayStreams {
+				streams <- stream
+			}
+		}
 
-		streams = append(streams, stream)
-	}
+		for _, addr := range conf.Syslog {
+			stream, err := syslogStream(addr, conf.Tag)
+			exitIfError(err)
+			streams <- stream
+		}
 
-	for _, gcloud := range conf.Gcloud {
-		streams = append(streams, gcloudStream(conf, gcloud))
-	}
+		if len(conf.Gcloud) != 0 {
+			logging, err := NewCloudLogging(context.Background(), conf.GcloudEndpoint)
+			exitIfError(err)
 
-	if conf.Listen != "" {
-		streams = append(streams, httpStream(conf.Listen, conf.Follow))
-	}
+			for _, gcloud := range conf.Gcloud {
+				streams <- gcloudStream(conf, logging, gcloud)
+			}
+		}
 
-	defer closeStreams(streams)
+		if conf.Listen != "" {
+			stream, err := httpStream(conf.Listen, conf.ListenToken, trustedProxies, conf.Tag)
+			exitIfError(err)
+			streams <- stream
+		}
+
+		wg := &sync.WaitGroup{}
+		if len(conf.Files) != 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := FileStreams(conf, streams, stop)
+				exitIfError(err)
+			}()
+		}
+		for _, kubernetesConf := range KubernetesConfigs(conf) {
+			kubernetesConf := kubernetesConf
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				k8s, err := NewKubernetes(kubernetesConf)
+				exitIfError(err)
+
+				err = k8s.Stream(streams, stop)
+				exitIfError(err)
+			}()
+		}
+		wg.Wait()
+	}()
 
-	streamLogs(streams, conf.Follow)
+	streamLogs(streams, conf, format, multilineConf, lineParser, lineFilter, redactor)
 }
 
 func logPid() {
@@ -137,11 +290,28 @@ func logPid() {
 	_ = json.NewEncoder(os.Stdout).Encode(entry)
 }
 
-func streamLogs(streams []io.ReadCloser, follow bool) {
+// Stream is a source of log lines, along with the fields identifying where they come from.
+type Stream struct {
+	io.ReadCloser
+	Fields map[string]interface{}
+	// Wrap is set for the raw output of commands: the lines that are not JSON objects once joined and parsed are
+	// wrapped in an entry with the line as the message.
+	Wrap bool
+}
+
+func streamLogs(streams <-chan Stream, conf Config, format normalize.Format, multilineConf multiline.Config, lineParser *LineParser, lineFilter *LineFilter, redactor *redact.Redactor) {
 	lines := make(chan string, 1000)
+	metrics.GaugeFunc(metricBacklog, func() float64 {
+		return float64(len(lines))
+	})
+	var ordered <-chan string = lines
+	if conf.Order > 0 {
+		ordered = reorder(lines, conf.Order)
+	}
+
 	done := make(chan struct{})
 	go func() {
-		for line := range lines {
+		for line := range ordered {
 			_, err := os.Stdout.Write(append([]byte(line), '\n'))
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -162,30 +332,65 @@ func streamLogs(streams []io.ReadCloser, follow bool) {
 	}()
 
 	wg := &sync.WaitGroup{}
-	for _, stream := range streams {
+	for stream := range streams {
 		stream := stream
 		wg.Add(1)
 		go func() {
+			defer wg.Done()
+			defer stream.Close()
+
+			labels := metrics.Labels(stream.Fields)
+			metrics.Inc(metricStreams, labels)
+			metrics.Add(metricStreamsActive, labels, 1)
+			defer metrics.Add(metricStreamsActive, labels, -1)
+
+			normalizer := normalize.New(format)
+			patterns := lineParser.Stream(stream.Fields)
+			filters := lineFilter.Stream(stream.Fields)
+			joiner := multiline.NewJoiner(multilineConf, func(event multiline.Event) {
+				line := event.Line
+				if b, ok := patterns.Parse(line); ok {
+					line = b
+				} else if stream.Wrap {
+					line = []byte(wrapLine(string(line), time.Now()))
+				}
+				line = redactor.Redact(multiline.Fold(normalizer.Normalize(line), event.Stacktrace))
+				ok, err := lineFilter.Match(filters, string(line), stream.Fields)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				}
+				if !ok {
+					metrics.Inc(metricLinesFiltered, labels)
+					return
+				}
+				if conf.Tag {
+					line = []byte(tagLine(string(line), stream.Fields))
+				}
+				lines <- string(line)
+			})
+			defer joiner.Close()
+
 			r := bufio.NewReader(stream)
 			for {
 				line, err := r.ReadString('\n')
 				if err == io.EOF {
-					if follow {
+					if conf.Follow {
+						metrics.Inc(metricStreamErrors, labels)
 						fmt.Fprintln(os.Stderr, "Error: stream ended")
 					}
-					wg.Done()
+					return
+				}
+				if err == errStreamDetached {
 					return
 				}
 				if err != nil {
+					metrics.Inc(metricStreamErrors, labels)
 					fmt.Fprintf(os.Stderr, "Error: reading line from logs: %v\n", err)
-					wg.Done()
 					return
 				}
-				line = strings.TrimSpace(line)
-				if line == "" {
-					continue
-				}
-				lines <- line
+				metrics.Inc(metricLines, labels)
+				metrics.Add(metricBytes, labels, float64(len(line)))
+				joiner.Add(line)
 			}
 		}()
 	}
@@ -201,15 +406,10 @@ func exitIfError(err error) {
 	}
 
 	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	StopCommands()
 	os.Exit(1)
 }
 
-func closeStreams(streams []io.ReadCloser) {
-	for _, stream := range streams {
-		stream.Close()
-	}
-}
-
 func homeDir() string {
 	h, err := os.UserHomeDir()
 	if err == nil {
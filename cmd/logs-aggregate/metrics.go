@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	metricStreams           = "logs_aggregate_streams_total"
+	metricStreamsActive     = "logs_aggregate_streams_active"
+	metricLines             = "logs_aggregate_lines_total"
+	metricBytes             = "logs_aggregate_bytes_total"
+	metricLinesFiltered     = "logs_aggregate_lines_filtered_total"
+	metricStreamErrors      = "logs_aggregate_stream_errors_total"
+	metricReconnects        = "logs_aggregate_reconnects_total"
+	metricBacklog           = "logs_aggregate_backlog_lines"
+	metricGcloudPoll        = "logs_aggregate_gcloud_poll_duration_seconds"
+	metricGcloudPollErrors  = "logs_aggregate_gcloud_poll_errors_total"
+	metricGcloudPollEntries = "logs_aggregate_gcloud_poll_entries_total"
+)
+
+type metricFamily struct {
+	name string
+	typ  string
+	help string
+}
+
+var (
+	metricFamilies = []metricFamily{
+		{metricStreams, "counter", "Streams opened."},
+		{metricStreamsActive, "gauge", "Streams currently being read."},
+		{metricLines, "counter", "Lines read from the streams."},
+		{metricBytes, "counter", "Bytes read from the streams."},
+		{metricLinesFiltered, "counter", "Lines dropped by the filters."},
+		{metricStreamErrors, "counter", "Streams that ended with an error."},
+		{metricReconnects, "counter", "Reconnections to pod logs and restarts of commands."},
+		{metricBacklog, "gauge", "Lines waiting to be written to stdout."},
+		{metricGcloudPoll, "summary", "Duration of the Cloud Logging polls."},
+		{metricGcloudPollErrors, "counter", "Cloud Logging polls that failed."},
+		{metricGcloudPollEntries, "counter", "Entries listed from Cloud Logging."},
+	}
+
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	// metrics is only set with -metrics-addr, collecting the metrics is a no-op otherwise.
+	metrics *Metrics
+)
+
+// Metrics holds counters and gauges, served in the Prometheus text format.
+// Series are identified by their name (including the _sum and _count suffixes of summaries) and labels.
+// The methods of a nil *Metrics do nothing.
+type Metrics struct {
+	values map[string]map[string]float64
+	funcs  map[string]func() float64
+	m      *sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		values: map[string]map[string]float64{},
+		funcs:  map[string]func() float64{},
+		m:      &sync.Mutex{},
+	}
+}
+
+// Labels formats the fields of a stream as labels, without their leading underscore.
+func (m *Metrics) Labels(fields map[string]interface{}) string {
+	if m == nil {
+		return ""
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ss := make([]string, 0, len(keys))
+	for _, k := range keys {
+		name := strings.TrimPrefix(k, "_")
+		if !validLabelName(name) {
+			continue
+		}
+		ss = append(ss, name+`="`+labelValueReplacer.Replace(fmt.Sprint(fields[k]))+`"`)
+	}
+
+	return strings.Join(ss, ",")
+}
+
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Metrics) Add(name, labels string, v float64) {
+	if m == nil {
+		return
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	series, ok := m.values[name]
+	if !ok {
+		series = map[string]float64{}
+		m.values[name] = series
+	}
+	series[labels] += v
+}
+
+func (m *Metrics) Inc(name, labels string) {
+	m.Add(name, labels, 1)
+}
+
+// Observe adds an observation to a summary.
+func (m *Metrics) Observe(name, labels string, v float64) {
+	m.Add(name+"_sum", labels, v)
+	m.Add(name+"_count", labels, 1)
+}
+
+// GaugeFunc sets a gauge without labels computed when the metrics are served.
+func (m *Metrics) GaugeFunc(name string, f func() float64) {
+	if m == nil {
+		return
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.funcs[name] = f
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = m.Write(w)
+}
+
+func (m *Metrics) Write(w io.Writer) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	var b strings.Builder
+	for _, family := range metricFamilies {
+		names := []string{family.name}
+		if family.typ == "summary" {
+			names = []string{family.name + "_sum", family.name + "_count"}
+		}
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.typ)
+		for _, name := range names {
+			if f, ok := m.funcs[name]; ok {
+				writeSample(&b, name, "", f())
+			}
+
+			series := m.values[name]
+			labels := make([]string, 0, len(series))
+			for l := range series {
+				labels = append(labels, l)
+			}
+			sort.Strings(labels)
+			for _, l := range labels {
+				writeSample(&b, name, l, series[l])
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeSample(b *strings.Builder, name, labels string, v float64) {
+	b.WriteString(name)
+	if labels != "" {
+		b.WriteString("{" + labels + "}")
+	}
+	b.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+// serveMetrics serves m on /metrics.
+func serveMetrics(addr string, m *Metrics) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		_ = http.Serve(listener, mux)
+	}()
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+
+	labels := m.Labels(map[string]interface{}{
+		"_source":    "file",
+		"_path":      `C:\logs\"app".log`,
+		"_tag":       "a\nb",
+		"_container": 3,
+		"invalid-":   "skipped",
+	})
+	m.Inc(metricLines, labels)
+	m.Add(metricLines, labels, 2)
+	m.Inc(metricLines, m.Labels(map[string]interface{}{"_source": "exec"}))
+	m.Add(metricStreamsActive, "", 1)
+	m.Observe(metricGcloudPoll, `project="p"`, 0.25)
+	m.Observe(metricGcloudPoll, `project="p"`, 0.5)
+	m.GaugeFunc(metricBacklog, func() float64 {
+		return 7
+	})
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	got := string(b)
+	for _, want := range []string{
+		"# HELP logs_aggregate_lines_total Lines read from the streams.\n# TYPE logs_aggregate_lines_total counter\n" +
+			`logs_aggregate_lines_total{container="3",path="C:\\logs\\\"app\".log",source="file",tag="a\nb"} 3` + "\n" +
+			`logs_aggregate_lines_total{source="exec"} 1` + "\n",
+		"# TYPE logs_aggregate_streams_active gauge\nlogs_aggregate_streams_active 1\n",
+		"# TYPE logs_aggregate_backlog_lines gauge\nlogs_aggregate_backlog_lines 7\n",
+		"# TYPE logs_aggregate_gcloud_poll_duration_seconds summary\n" +
+			`logs_aggregate_gcloud_poll_duration_seconds_sum{project="p"} 0.75` + "\n" +
+			`logs_aggregate_gcloud_poll_duration_seconds_count{project="p"} 2` + "\n",
+		// families without samples are still described
+		"# HELP logs_aggregate_reconnects_total Reconnections to pod logs and restarts of commands.\n# TYPE logs_aggregate_reconnects_total counter\n# HELP",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain:\n%s\ngot:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "skipped") {
+		t.Errorf("invalid label name exported:\n%s", got)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+
+	if labels := m.Labels(map[string]interface{}{"_source": "file"}); labels != "" {
+		t.Errorf("Labels = %q, want none", labels)
+	}
+	m.Inc(metricLines, "")
+	m.Observe(metricGcloudPoll, "", 1)
+	m.GaugeFunc(metricBacklog, func() float64 {
+		return 0
+	})
+}
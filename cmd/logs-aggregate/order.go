@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ReorderMaxLines is the maximum number of lines held by the reorder buffer, the oldest lines are written
+// early when it is full.
+var ReorderMaxLines = 100000
+
+// reorder writes the lines from in ordered by their "time" field, holding each line for up to window to let
+// older lines from other streams arrive. Lines older than the last line written are written right away with
+// the "_late" field, lines without a timestamp are written right away.
+func reorder(in <-chan string, window time.Duration) <-chan string {
+	out := make(chan string, cap(in))
+
+	go func() {
+		defer close(out)
+
+		b := &reorderBuffer{}
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+
+		for {
+			deadline, ok := b.nextDeadline()
+			if ok {
+				resetTimer(timer, time.Until(deadline))
+			}
+
+			select {
+			case line, ok := <-in:
+				if !ok {
+					b.flush(out)
+					return
+				}
+				b.add(line, time.Now(), window, out)
+			case <-timer.C:
+				b.release(time.Now(), out)
+			}
+		}
+	}()
+
+	return out
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+type reorderItem struct {
+	t        time.Time
+	seq      uint64
+	line     string
+	deadline time.Time
+	written  bool
+}
+
+// reorderBuffer holds the lines in a heap ordered by timestamp, and in a queue ordered by arrival so that each
+// line is written by its deadline: when the oldest line expires, the lines older than it are written first.
+type reorderBuffer struct {
+	lines   reorderHeap
+	arrival []*reorderItem
+	seq     uint64
+	last    time.Time
+}
+
+func (b *reorderBuffer) add(line string, now time.Time, window time.Duration, out chan<- string) {
+	t := lineTime(line)
+	if t.IsZero() {
+		out <- line
+		return
+	}
+	if t.Before(b.last) {
+		out <- tagLine(line, map[string]interface{}{"_late": true})
+		return
+	}
+
+	b.seq++
+	item := &reorderItem{
+		t:        t,
+		seq:      b.seq,
+		line:     line,
+		deadline: now.Add(window),
+	}
+	heap.Push(&b.lines, item)
+	b.arrival = append(b.arrival, item)
+
+	for len(b.lines) > ReorderMaxLines {
+		b.write(out)
+	}
+}
+
+func (b *reorderBuffer) nextDeadline() (time.Time, bool) {
+	b.dropWritten()
+	if len(b.arrival) == 0 {
+		return time.Time{}, false
+	}
+
+	return b.arrival[0].deadline, true
+}
+
+func (b *reorderBuffer) release(now time.Time, out chan<- string) {
+	for {
+		b.dropWritten()
+		if len(b.arrival) == 0 || b.arrival[0].deadline.After(now) {
+			return
+		}
+
+		expired := b.arrival[0]
+		for !expired.written {
+			b.write(out)
+		}
+	}
+}
+
+func (b *reorderBuffer) flush(out chan<- string) {
+	for len(b.lines) != 0 {
+		b.write(out)
+	}
+	b.arrival = nil
+}
+
+func (b *reorderBuffer) write(out chan<- string) {
+	item := heap.Pop(&b.lines).(*reorderItem)
+	item.written = true
+	b.last = item.t
+	out <- item.line
+}
+
+func (b *reorderBuffer) dropWritten() {
+	i := 0
+	for i < len(b.arrival) && b.arrival[i].written {
+		b.arrival[i] = nil
+		i++
+	}
+	b.arrival = b.arrival[i:]
+}
+
+func lineTime(line string) time.Time {
+	r := gjson.Get(line, "time")
+	if r.Type != gjson.String {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, r.Str)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+type reorderHeap []*reorderItem
+
+func (h reorderHeap) Len() int {
+	return len(h)
+}
+
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].t.Equal(h[j].t) {
+		return h[i].seq < h[j].seq
+	}
+
+	return h[i].t.Before(h[j].t)
+}
+
+func (h reorderHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *reorderHeap) Push(x interface{}) {
+	*h = append(*h, x.(*reorderItem))
+}
+
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return item
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func timedLine(seconds int, msg string) string {
+	return fmt.Sprintf(`{"time":%q,"msg":%q}`, testEpoch.Add(time.Duration(seconds)*time.Second).Format(time.RFC3339Nano), msg)
+}
+
+// written returns the messages of the lines written to out so far, with the late ones suffixed by "(late)".
+func written(out chan string) []string {
+	msgs := []string{}
+	for {
+		select {
+		case line := <-out:
+			msg := gjson.Get(line, "msg").String()
+			if gjson.Get(line, "_late").Bool() {
+				msg += " (late)"
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	const window = 5 * time.Second
+	// the buffer is given the time, now is a fake clock
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+	out := make(chan string, 10)
+	b := &reorderBuffer{}
+
+	b.add(timedLine(3, "c"), at(0), window, out)
+	b.add(timedLine(1, "a"), at(1), window, out)
+	b.add(`{"msg":"no time"}`, at(1), window, out)
+	b.add(timedLine(2, "b"), at(2), window, out)
+	if got, want := written(out), []string{"no time"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written = %q, want %q", got, want)
+	}
+
+	if deadline, ok := b.nextDeadline(); !ok || !deadline.Equal(at(5)) {
+		t.Errorf("next deadline = %v, %t, want %v", deadline, ok, at(5))
+	}
+	b.release(at(4), out)
+	if got := written(out); len(got) != 0 {
+		t.Fatalf("written before the window passed = %q", got)
+	}
+
+	// the first line held expires, the older lines held are written before it
+	b.release(at(5), out)
+	if got, want := written(out), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written = %q, want %q", got, want)
+	}
+	if _, ok := b.nextDeadline(); ok {
+		t.Error("lines still held after the release")
+	}
+
+	// lines older than the last line written are late
+	b.add(timedLine(2, "late"), at(6), window, out)
+	b.add(timedLine(3, "same time"), at(6), window, out)
+	b.add(timedLine(4, "d"), at(7), window, out)
+	if got, want := written(out), []string{"late (late)"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written = %q, want %q", got, want)
+	}
+	b.release(at(11), out)
+	if got, want := written(out), []string{"same time"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written = %q, want %q", got, want)
+	}
+	b.flush(out)
+	if got, want := written(out), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written = %q, want %q", got, want)
+	}
+}
+
+func TestReorderBufferMaxLines(t *testing.T) {
+	defer func(max int) { ReorderMaxLines = max }(ReorderMaxLines)
+	ReorderMaxLines = 2
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	out := make(chan string, 10)
+	b := &reorderBuffer{}
+
+	b.add(timedLine(3, "c"), now, time.Hour, out)
+	b.add(timedLine(1, "a"), now, time.Hour, out)
+	if got := written(out); len(got) != 0 {
+		t.Fatalf("written = %q, want none", got)
+	}
+
+	// the buffer is full, the oldest line is written
+	b.add(timedLine(2, "b"), now, time.Hour, out)
+	if got, want := written(out), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written = %q, want %q", got, want)
+	}
+	b.add(timedLine(4, "d"), now, time.Hour, out)
+	if got, want := written(out), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written = %q, want %q", got, want)
+	}
+
+	b.flush(out)
+	if got, want := written(out), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written = %q, want %q", got, want)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	in := make(chan string, 10)
+	out := reorder(in, 50*time.Millisecond)
+
+	in <- timedLine(2, "b")
+	in <- timedLine(1, "a")
+	got := []string{}
+	for len(got) < 2 {
+		select {
+		case line := <-out:
+			got = append(got, gjson.Get(line, "msg").String())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the lines held, got %q", got)
+		}
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+
+	in <- timedLine(4, "d")
+	in <- timedLine(3, "c")
+	close(in)
+	got = []string{}
+	for line := range out {
+		got = append(got, gjson.Get(line, "msg").String())
+	}
+	if want := []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines flushed on close = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	ReconnectMinBackoff = 500 * time.Millisecond
+	ReconnectMaxBackoff = 30 * time.Second
+
+	errPodStreamClosed = errors.New("pod stream closed")
+)
+
+// podStream follows the logs of a pod's container, reconnecting with an exponential backoff when the
+// underlying stream ends. Reconnections resume from the last timestamp seen, skipping the lines already sent.
+// When the container restarts, the end of the previous container's logs is written too.
+// The stream ends with errStreamDetached once it is closed, or when the pod is deleted or terminated.
+type podStream struct {
+	k8s       *Kubernetes
+	namespace string
+	podName   string
+	container string
+	init      bool
+
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	logs   io.ReadCloser
+	closed bool
+	done   chan struct{}
+	m      *sync.Mutex
+
+	// lines is the state of the lines written, ended its copy when the last logs stream ended. Both, and
+	// restarts, are guarded by lines.m.
+	lines    *lineState
+	ended    *lineState
+	restarts int32
+}
+
+// lineState is the last timestamp of the lines written, with how many times each line with this timestamp
+// was written.
+type lineState struct {
+	lastTime time.Time
+	seen     map[string]int
+	m        *sync.Mutex
+}
+
+func newLineState() *lineState {
+	return &lineState{
+		seen: map[string]int{},
+		m:    &sync.Mutex{},
+	}
+}
+
+// snapshot returns a copy of the state, with its own mutex. The caller must hold ls.m.
+func (ls *lineState) snapshot() *lineState {
+	c := newLineState()
+	c.lastTime = ls.lastTime
+	for msg, n := range ls.seen {
+		c.seen[msg] = n
+	}
+
+	return c
+}
+
+func (ls *lineState) sinceTime() *metav1.Time {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	if ls.lastTime.IsZero() {
+		return nil
+	}
+
+	return &metav1.Time{Time: ls.lastTime}
+}
+
+func newPodStream(k8s *Kubernetes, pod *v1.Pod, container string, logs io.ReadCloser) *podStream {
+	r, w := io.Pipe()
+	s := &podStream{
+		k8s:       k8s,
+		namespace: pod.GetNamespace(),
+		podName:   pod.GetName(),
+		container: container,
+		init:      isInitContainer(pod, container),
+
+		r: r,
+		w: w,
+
+		logs: logs,
+		done: make(chan struct{}),
+		m:    &sync.Mutex{},
+
+		lines: newLineState(),
+		ended: newLineState(),
+	}
+	s.restarts, _ = containerRestarts(pod, container)
+
+	go s.run(logs)
+
+	return s
+}
+
+func (s *podStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *podStream) Close() error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	logs := s.logs
+	s.m.Unlock()
+
+	if logs != nil {
+		_ = logs.Close()
+	}
+
+	return s.w.CloseWithError(errStreamDetached)
+}
+
+func (s *podStream) run(logs io.ReadCloser) {
+	var err error
+	attempt := 0
+
+	for {
+		if logs != nil {
+			var n int
+			n, err = s.copyLines(logs, s.lines, nil)
+			_ = logs.Close()
+			if n != 0 {
+				attempt = 0
+			}
+
+			s.lines.m.Lock()
+			s.ended = s.lines.snapshot()
+			s.lines.m.Unlock()
+		}
+
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if !s.shouldReconnect() {
+			s.trace("logs stream ended, not reconnecting", map[string]interface{}{})
+			_ = s.w.CloseWithError(errStreamDetached)
+			return
+		}
+
+		attempt++
+		backoff := reconnectBackoff(attempt)
+		fields := map[string]interface{}{
+			"attempt": attempt,
+			"backoff": backoff.String(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		s.trace("reconnecting to pod logs", fields)
+		metrics.Inc(metricReconnects, metrics.Labels(map[string]interface{}{
+			"_source":    "kubernetes",
+			"_context":   s.k8s.context,
+			"_namespace": s.namespace,
+			"_pod":       s.podName,
+			"_container": s.container,
+		}))
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		logs, err = s.reopen()
+	}
+}
+
+// restarted is called with the updates of the pod. When the restart count of the container increased, it
+// writes the logs of the previous container, marked with _previous.
+func (s *podStream) restarted(pod *v1.Pod) {
+	restarts, ok := containerRestarts(pod, s.container)
+	if !ok {
+		return
+	}
+
+	s.lines.m.Lock()
+	if restarts <= s.restarts {
+		s.lines.m.Unlock()
+		return
+	}
+	s.restarts = restarts
+	// the lines already written are skipped, unless lines of the new container were written since, in which
+	// case the lines written until the last logs stream ended are
+	state := s.lines.snapshot()
+	if started, ok := containerStarted(pod, s.container); ok && !state.lastTime.Before(started) {
+		state = s.ended.snapshot()
+	}
+	s.lines.m.Unlock()
+
+	go s.showPrevious(restarts, state)
+}
+
+// showPrevious writes the end of the previous container's logs, skipping the lines in state.
+func (s *podStream) showPrevious(restarts int32, state *lineState) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	opts := s.k8s.logOptions(s.container, state.sinceTime())
+	opts.Follow = false
+	opts.Previous = true
+	if s.k8s.restartTail >= 0 {
+		tail := s.k8s.restartTail
+		opts.TailLines = &tail
+	}
+
+	logs, err := s.k8s.openLogs(s.namespace, s.podName, opts)
+	if err != nil {
+		s.trace("container restarted, failed to get the logs of the previous container", map[string]interface{}{
+			"restart_count": restarts,
+			"error":         err.Error(),
+		})
+		return
+	}
+	defer logs.Close()
+
+	s.trace("container restarted, showing the logs of the previous container", map[string]interface{}{
+		"restart_count": restarts,
+	})
+	_, _ = s.copyLines(logs, state, map[string]interface{}{
+		"_previous":      true,
+		"_restart_count": restarts - 1,
+	})
+}
+
+func (s *podStream) reopen() (io.ReadCloser, error) {
+	logs, err := s.k8s.openLogs(s.namespace, s.podName, s.k8s.logOptions(s.container, s.lines.sinceTime()))
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		_ = logs.Close()
+		return nil, errPodStreamClosed
+	}
+	s.logs = logs
+
+	return logs, nil
+}
+
+// copyLines writes the lines from logs to the pipe, stripping the timestamps added by the API server and
+// adding marker fields if any. Lines that are not newer than the last timestamp of state are only written if
+// they were not written before.
+func (s *podStream) copyLines(logs io.Reader, state *lineState, marker map[string]interface{}) (int, error) {
+	n := 0
+	state.m.Lock()
+	resuming := !state.lastTime.IsZero()
+	state.m.Unlock()
+	replayed := map[string]int{}
+
+	r := bufio.NewReader(logs)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+
+		t, msg := splitTimestamp(strings.TrimRight(line, "\r\n"))
+		if !state.add(t, msg, &resuming, replayed) {
+			continue
+		}
+
+		if marker != nil {
+			msg = tagLine(msg, marker)
+		}
+		_, werr := s.w.Write([]byte(msg + "\n"))
+		if werr != nil {
+			return n, werr
+		}
+		n++
+	}
+}
+
+// add records a line, reporting whether it must be written.
+func (ls *lineState) add(t time.Time, msg string, resuming *bool, replayed map[string]int) bool {
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	switch {
+	case t.IsZero():
+	case t.Before(ls.lastTime):
+		return false
+	case t.Equal(ls.lastTime) && *resuming && replayed[msg] < ls.seen[msg]:
+		replayed[msg]++
+		return false
+	case t.After(ls.lastTime):
+		*resuming = false
+		ls.lastTime = t
+		ls.seen = map[string]int{}
+	}
+	ls.seen[msg]++
+
+	return true
+}
+
+// shouldReconnect reports whether more logs can be expected from the container: the pod must still exist and
+// be neither terminated nor, for init containers, running.
+func (s *podStream) shouldReconnect() bool {
+	pod, err := s.k8s.pods.Pods(s.namespace).Get(s.podName)
+	if apierrors.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+
+	switch pod.Status.Phase {
+	case v1.PodSucceeded, v1.PodFailed:
+		return false
+	case v1.PodRunning:
+		return !s.init
+	default:
+		return true
+	}
+}
+
+// containerStatus returns the status of a container, the default container being the first one.
+func containerStatus(pod *v1.Pod, container string) (v1.ContainerStatus, bool) {
+	if container == "" && len(pod.Spec.Containers) != 0 {
+		container = pod.Spec.Containers[0].Name
+	}
+
+	for _, statuses := range [][]v1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if status.Name == container {
+				return status, true
+			}
+		}
+	}
+
+	return v1.ContainerStatus{}, false
+}
+
+func containerRestarts(pod *v1.Pod, container string) (int32, bool) {
+	status, ok := containerStatus(pod, container)
+
+	return status.RestartCount, ok
+}
+
+// containerStarted returns the time the current container started.
+func containerStarted(pod *v1.Pod, container string) (time.Time, bool) {
+	status, ok := containerStatus(pod, container)
+	switch {
+	case !ok:
+		return time.Time{}, false
+	case status.State.Running != nil:
+		return status.State.Running.StartedAt.Time, true
+	case status.State.Terminated != nil:
+		return status.State.Terminated.StartedAt.Time, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func isInitContainer(pod *v1.Pod, container string) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == container {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *podStream) trace(msg string, fields map[string]interface{}) {
+	fields["time"] = time.Now()
+	fields["level"] = "trace"
+	fields["msg"] = msg
+	fields["namespace"] = s.namespace
+	fields["pod"] = s.podName
+	fields["container"] = s.container
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	_, _ = s.w.Write(append(b, '\n'))
+}
+
+func splitTimestamp(line string) (time.Time, string) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return time.Time{}, line
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, line[:i])
+	if err != nil {
+		return time.Time{}, line
+	}
+
+	return t, line[i+1:]
+}
+
+func reconnectBackoff(attempt int) time.Duration {
+	backoff := ReconnectMinBackoff
+	for i := 1; i < attempt && backoff < ReconnectMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > ReconnectMaxBackoff {
+		backoff = ReconnectMaxBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayControl pauses and seeks the replays. Waiting replays are woken up through changed, which is closed and
+// replaced on every change.
+type replayControl struct {
+	paused  bool
+	skips   map[*replayer]time.Duration
+	changed chan struct{}
+	m       *sync.Mutex
+}
+
+func newReplayControl() *replayControl {
+	return &replayControl{
+		skips:   map[*replayer]time.Duration{},
+		changed: make(chan struct{}),
+		m:       &sync.Mutex{},
+	}
+}
+
+var replay = newReplayControl()
+
+func (c *replayControl) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// TogglePause pauses or resumes the replays.
+func (c *replayControl) TogglePause() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.paused = !c.paused
+	c.notify()
+}
+
+// Seek skips ahead in the replays, by d of the time of the entries.
+func (c *replayControl) Seek(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for r := range c.skips {
+		c.skips[r] += d
+	}
+	c.notify()
+}
+
+func (c *replayControl) add(r *replayer, skip time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.skips[r] = skip
+}
+
+func (c *replayControl) remove(r *replayer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	delete(c.skips, r)
+}
+
+// state returns whether the replays are paused, and takes up to d from the time left to skip by r.
+func (c *replayControl) state(r *replayer, d time.Duration) (bool, time.Duration, <-chan struct{}) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	skip := c.skips[r]
+	if skip > d {
+		skip = d
+	}
+	c.skips[r] -= skip
+
+	return c.paused, skip, c.changed
+}
+
+// replayer replays files on a single timeline: the entries of all the files are written in the order of their
+// times, each to the stream of its file, following the delays between them.
+type replayer struct {
+	speed   float64
+	maxGap  time.Duration
+	control *replayControl
+	stop    <-chan struct{}
+
+	files    []*replayFile
+	previous time.Time
+}
+
+// replayFile is a replayed file, with its next line.
+type replayFile struct {
+	r    *bufio.Reader
+	w    *io.PipeWriter
+	line string
+	// t is the time of line, or of the last line with a time before it
+	t    time.Time
+	done bool
+}
+
+// ReplayStreams returns a stream for each saved file (i.e. written with the dashboard's 's' key), writing the
+// entries of all the files in the order of their times, following the delays between them divided by
+// -replay-speed and capped at -replay-max-gap. Lines without a time follow the line before them. Entries before
+// -replay-seek are written without delay; the replay can be paused and skipped ahead with signals (see
+// notifyReplayControls).
+func ReplayStreams(conf Config, stop <-chan struct{}) ([]Stream, error) {
+	if conf.ReplaySpeed <= 0 {
+		return nil, fmt.Errorf("invalid replay speed %v", conf.ReplaySpeed)
+	}
+
+	files := make([]*os.File, 0, len(conf.Replay))
+	for _, path := range conf.Replay {
+		f, err := os.Open(path)
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	r := &replayer{
+		speed:   conf.ReplaySpeed,
+		maxGap:  conf.ReplayMaxGap,
+		control: replay,
+		stop:    stop,
+	}
+	streams := make([]Stream, 0, len(files))
+	for _, f := range files {
+		pr, pw := io.Pipe()
+		r.files = append(r.files, &replayFile{
+			r: bufio.NewReader(f),
+			w: pw,
+		})
+
+		streams = append(streams, Stream{
+			ReadCloser: pr,
+			Fields: map[string]interface{}{
+				"_source": "replay",
+				"_file":   f.Name(),
+			},
+		})
+	}
+
+	r.control.add(r, conf.ReplaySeek)
+	go func() {
+		defer func() {
+			for _, f := range files {
+				_ = f.Close()
+			}
+		}()
+		r.run()
+	}()
+
+	return streams, nil
+}
+
+func (r *replayer) run() {
+	defer r.control.remove(r)
+
+	for _, f := range r.files {
+		f.next()
+	}
+
+	for {
+		f := r.earliest()
+		if f == nil {
+			return
+		}
+
+		if !r.wait(replayGap(r.previous, f.t, r.maxGap)) {
+			for _, f := range r.files {
+				_ = f.w.CloseWithError(errStreamDetached)
+			}
+			return
+		}
+		if f.t.After(r.previous) {
+			r.previous = f.t
+		}
+
+		if _, err := io.WriteString(f.w, f.line); err != nil {
+			f.done = true
+			continue
+		}
+		f.next()
+	}
+}
+
+// earliest returns the file with the earliest next line, the first of the files for equal times.
+func (r *replayer) earliest() *replayFile {
+	var earliest *replayFile
+	for _, f := range r.files {
+		if f.done {
+			continue
+		}
+		if earliest == nil || f.t.Before(earliest.t) {
+			earliest = f
+		}
+	}
+
+	return earliest
+}
+
+// next reads the next non-empty line, closing the stream at the end of the file.
+func (f *replayFile) next() {
+	for {
+		line, err := f.r.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			f.line = line
+			if t := lineTime(line); !t.IsZero() {
+				f.t = t
+			}
+			return
+		}
+		if err == io.EOF {
+			_ = f.w.Close()
+			f.done = true
+			return
+		}
+		if err != nil {
+			_ = f.w.CloseWithError(err)
+			f.done = true
+			return
+		}
+	}
+}
+
+// replayGap returns the delay before an entry at t, previous being the latest time replayed so far.
+func replayGap(previous, t time.Time, maxGap time.Duration) time.Duration {
+	if t.IsZero() || previous.IsZero() || !t.After(previous) {
+		return 0
+	}
+
+	gap := t.Sub(previous)
+	if maxGap > 0 && gap > maxGap {
+		gap = maxGap
+	}
+
+	return gap
+}
+
+// wait waits for d of the time of the entries, and for the replay to be resumed if it is paused. It returns
+// false if stop is closed.
+func (r *replayer) wait(d time.Duration) bool {
+	for {
+		paused, skip, changed := r.control.state(r, d)
+		d -= skip
+		if paused {
+			select {
+			case <-changed:
+				continue
+			case <-r.stop:
+				return false
+			}
+		}
+		if d <= 0 {
+			return true
+		}
+
+		start := time.Now()
+		timer := time.NewTimer(time.Duration(float64(d) / r.speed))
+		select {
+		case <-timer.C:
+			return true
+		case <-changed:
+			timer.Stop()
+			d -= time.Duration(float64(time.Since(start)) * r.speed)
+		case <-r.stop:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// controlReplay pauses the replay and skips ahead by step when receiving the control signals.
+func controlReplay(step time.Duration, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	if !notifyReplayControls(signals) {
+		return
+	}
+
+	go func() {
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case sig := <-signals:
+				if isReplayPauseSignal(sig) {
+					replay.TogglePause()
+					continue
+				}
+				replay.Seek(step)
+			}
+		}
+	}()
+}
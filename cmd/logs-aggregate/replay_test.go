@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestReplayGap(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous time.Time
+		t        time.Time
+		maxGap   time.Duration
+		want     time.Duration
+	}{
+		{"gap", testEpoch, testEpoch.Add(3 * time.Second), 0, 3 * time.Second},
+		{"max gap", testEpoch, testEpoch.Add(time.Hour), time.Minute, time.Minute},
+		{"under max gap", testEpoch, testEpoch.Add(time.Second), time.Minute, time.Second},
+		{"first entry", time.Time{}, testEpoch, 0, 0},
+		{"line without time", testEpoch, time.Time{}, 0, 0},
+		{"earlier entry", testEpoch, testEpoch.Add(-time.Second), 0, 0},
+		{"same time", testEpoch, testEpoch, 0, 0},
+	}
+
+	for _, test := range tests {
+		if got := replayGap(test.previous, test.t, test.maxGap); got != test.want {
+			t.Errorf("%s: gap = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func testReplayer(speed float64, seek time.Duration, stop <-chan struct{}) *replayer {
+	r := &replayer{
+		speed:   speed,
+		control: newReplayControl(),
+		stop:    stop,
+	}
+	r.control.add(r, seek)
+
+	return r
+}
+
+// timeWait returns how long wait took, failing if it took longer than 5s.
+func timeWait(t *testing.T, r *replayer, d time.Duration) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+	if !r.wait(d) {
+		t.Fatal("wait returned false without being stopped")
+	}
+
+	return time.Since(start)
+}
+
+func TestReplayWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		speed   float64
+		seek    time.Duration
+		waits   []time.Duration
+		minimum time.Duration
+		maximum time.Duration
+	}{
+		{
+			name:    "speed",
+			speed:   100,
+			waits:   []time.Duration{5 * time.Second},
+			minimum: 50 * time.Millisecond,
+			maximum: time.Second,
+		},
+		{
+			name:    "slowed down",
+			speed:   0.5,
+			waits:   []time.Duration{20 * time.Millisecond},
+			minimum: 40 * time.Millisecond,
+			maximum: time.Second,
+		},
+		{
+			name:    "seek",
+			speed:   1,
+			seek:    time.Hour,
+			waits:   []time.Duration{time.Minute, 59 * time.Minute},
+			maximum: 100 * time.Millisecond,
+		},
+		{
+			name:    "seek partially through a wait",
+			speed:   100,
+			seek:    2 * time.Second,
+			waits:   []time.Duration{time.Second, 6 * time.Second},
+			minimum: 50 * time.Millisecond,
+			maximum: time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := testReplayer(test.speed, test.seek, make(chan struct{}))
+			elapsed := time.Duration(0)
+			for _, d := range test.waits {
+				elapsed += timeWait(t, r, d)
+			}
+			if elapsed < test.minimum || elapsed > test.maximum {
+				t.Errorf("waited %v, want between %v and %v", elapsed, test.minimum, test.maximum)
+			}
+		})
+	}
+}
+
+func TestReplayWaitPauseAndSeek(t *testing.T) {
+	stop := make(chan struct{})
+	r := testReplayer(1, 0, stop)
+
+	r.control.TogglePause()
+	done := make(chan bool, 1)
+	go func() {
+		done <- r.wait(time.Hour)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// resuming keeps waiting for the rest of the hour, until skipped ahead
+	r.control.TogglePause()
+	select {
+	case <-done:
+		t.Fatal("wait returned once resumed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.control.Seek(time.Hour)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("wait returned false without being stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the seek")
+	}
+
+	go func() {
+		done <- r.wait(time.Hour)
+	}()
+	close(stop)
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("wait returned true once stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stop")
+	}
+}
+
+func TestReplayerMergesFiles(t *testing.T) {
+	entry := func(seconds int, msg string) string {
+		return fmt.Sprintf(`{"time":%q,"msg":%q}`+"\n", testEpoch.Add(time.Duration(seconds)*time.Second).Format(time.RFC3339Nano), msg)
+	}
+	contents := []string{
+		entry(0, "a0") + `{"msg":"no time"}` + "\n" + entry(30, "a30"),
+		entry(10, "b10") + "\n" + entry(20, "b20") + entry(40, "b40"),
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	r := testReplayer(1000, 0, stop)
+	readers := make([]*bufio.Reader, len(contents))
+	for i, content := range contents {
+		pr, pw := io.Pipe()
+		r.files = append(r.files, &replayFile{
+			r: bufio.NewReader(strings.NewReader(content)),
+			w: pw,
+		})
+		readers[i] = bufio.NewReader(pr)
+	}
+
+	type received struct {
+		file int
+		msg  string
+		at   time.Time
+	}
+	lines := make(chan received, 10)
+	for i, br := range readers {
+		i, br := i, br
+		go func() {
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				lines <- received{file: i, msg: gjson.Get(line, "msg").Str, at: time.Now()}
+			}
+		}()
+	}
+
+	start := time.Now()
+	go r.run()
+
+	got := []string{}
+	var last received
+	for len(got) < 6 {
+		select {
+		case l := <-lines:
+			got = append(got, fmt.Sprintf("%d:%s", l.file, l.msg))
+			if l.at.After(last.at) {
+				last = l
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %v", got)
+		}
+	}
+
+	// 10s between the entries at speed 1000 leaves 10ms between them, enough to tell the order apart
+	want := []string{"0:a0", "0:no time", "1:b10", "1:b20", "0:a30", "1:b40"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+	if elapsed := last.at.Sub(start); elapsed < 40*time.Millisecond {
+		t.Errorf("replayed in %v, want at least 40ms for 40s at speed 1000", elapsed)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReplayControls relays SIGUSR1, which pauses or resumes the replay, and SIGUSR2, which skips ahead.
+func notifyReplayControls(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	return true
+}
+
+func isReplayPauseSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR1
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+)
+
+// notifyReplayControls does nothing, since there are no signals to control the replay with on windows.
+func notifyReplayControls(chan<- os.Signal) bool {
+	return false
+}
+
+func isReplayPauseSignal(os.Signal) bool {
+	return false
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxSyslogMessage = 64 * 1024
+
+	stampWithYear = "Jan _2 2006 15:04:05"
+)
+
+var (
+	syslogLevels = []string{"panic", "fatal", "fatal", "error", "warning", "info", "info", "debug"}
+
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+)
+
+// syslogStream listens for syslog messages on addr, which can be prefixed with udp:// or tcp://
+// to only listen on one of them. Messages are converted to JSON lines.
+func syslogStream(addr string, tag bool) (Stream, error) {
+	network := ""
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		network, addr = "udp", strings.TrimPrefix(addr, "udp://")
+	case strings.HasPrefix(addr, "tcp://"):
+		network, addr = "tcp", strings.TrimPrefix(addr, "tcp://")
+	}
+
+	r, w := io.Pipe()
+	s := &syslogServer{
+		w:   w,
+		tag: tag,
+	}
+
+	if network == "" || network == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return Stream{}, err
+		}
+		s.closers = append(s.closers, conn)
+		go s.serveUDP(conn)
+	}
+	if network == "" || network == "tcp" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.Close()
+			return Stream{}, err
+		}
+		s.closers = append(s.closers, listener)
+		go s.serveTCP(listener)
+	}
+
+	return Stream{
+		ReadCloser: readCloser{
+			Reader: r,
+			closeFn: func() error {
+				s.Close()
+				return r.Close()
+			},
+		},
+		Fields: map[string]interface{}{
+			"_source": "syslog",
+			"_listen": addr,
+		},
+	}, nil
+}
+
+type syslogServer struct {
+	w       *io.PipeWriter
+	tag     bool
+	closers []io.Closer
+	m       sync.Mutex
+}
+
+func (s *syslogServer) Close() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, c := range s.closers {
+		_ = c.Close()
+	}
+	_ = s.w.Close()
+}
+
+func (s *syslogServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.write(buf[:n], remote)
+	}
+}
+
+func (s *syslogServer) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			for {
+				frame, err := readSyslogFrame(r)
+				if len(frame) != 0 {
+					s.write(frame, conn.RemoteAddr())
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *syslogServer) write(msg []byte, remote net.Addr) {
+	entry := parseSyslog(msg, time.Now())
+	if entry == nil {
+		return
+	}
+	if s.tag && remote != nil {
+		entry["_remote_addr"] = remote.String()
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, _ = s.w.Write(append(b, '\n'))
+}
+
+// readSyslogFrame reads a message framed either with octet counting ("LEN SP MSG") or with a trailing newline.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[0] >= '1' && b[0] <= '9' {
+		count, err := r.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n > maxSyslogMessage {
+			return nil, fmt.Errorf("invalid octet count %q", count)
+		}
+		frame := make([]byte, n)
+		_, err = io.ReadFull(r, frame)
+		return frame, err
+	}
+
+	frame, err := r.ReadBytes('\n')
+	if err == io.EOF && len(frame) != 0 {
+		return frame, nil
+	}
+
+	return frame, err
+}
+
+// parseSyslog parses an RFC 5424 or RFC 3164 message. Messages that cannot be parsed are kept as the message
+// of the entry.
+func parseSyslog(b []byte, now time.Time) map[string]interface{} {
+	s := strings.TrimRight(string(b), "\r\n\x00")
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+
+	pri, rest, err := parsePriority(s)
+	if err != nil {
+		return map[string]interface{}{
+			"time":  now,
+			"level": "info",
+			"msg":   s,
+		}
+	}
+
+	var entry map[string]interface{}
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		entry, err = parseRFC5424(rest[2:], now)
+	} else {
+		entry = parseRFC3164(rest, now)
+	}
+	if err != nil {
+		entry = map[string]interface{}{
+			"time": now,
+			"msg":  rest,
+		}
+	}
+
+	severity := pri % 8
+	facility := pri / 8
+	entry["level"] = syslogLevels[severity]
+	entry["severity"] = syslogSeverities[severity]
+	if facility < len(syslogFacilities) {
+		entry["facility"] = syslogFacilities[facility]
+	}
+
+	return entry
+}
+
+func parsePriority(s string) (int, string, error) {
+	if !strings.HasPrefix(s, "<") {
+		return 0, s, errors.New("missing priority")
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return 0, s, errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return 0, s, errors.New("invalid priority")
+	}
+
+	return pri, s[end+1:], nil
+}
+
+// parseRFC5424 parses "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]".
+func parseRFC5424(s string, now time.Time) (map[string]interface{}, error) {
+	headers := make([]string, 5)
+	for i := range headers {
+		var ok bool
+		headers[i], s, ok = nextSyslogToken(s)
+		if !ok {
+			return nil, errors.New("truncated header")
+		}
+	}
+
+	entry := map[string]interface{}{
+		"time": now,
+	}
+	if t, err := time.Parse(time.RFC3339Nano, headers[0]); err == nil {
+		entry["time"] = t
+	}
+	for i, k := range []string{"", "hostname", "app_name", "procid", "msgid"} {
+		if k == "" || headers[i] == "-" {
+			continue
+		}
+		entry[k] = headers[i]
+	}
+
+	sd, msg, err := parseStructuredData(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd) != 0 {
+		entry["structured_data"] = sd
+	}
+
+	msg = strings.TrimPrefix(strings.TrimPrefix(msg, " "), "\ufeff")
+	if !utf8.ValidString(msg) {
+		msg = strings.ToValidUTF8(msg, "\ufffd")
+	}
+	entry["msg"] = msg
+
+	return entry, nil
+}
+
+func nextSyslogToken(s string) (token, rest string, ok bool) {
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, "", s != ""
+	}
+
+	return s[:i], s[i+1:], true
+}
+
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+	if strings.HasPrefix(s, "-") {
+		return nil, s[1:], nil
+	}
+
+	sd := map[string]map[string]string{}
+	for strings.HasPrefix(s, "[") {
+		end := strings.IndexAny(s, " ]")
+		if end < 0 {
+			return nil, s, errors.New("unterminated structured data")
+		}
+		params := map[string]string{}
+		sd[s[1:end]] = params
+		s = s[end:]
+
+		for {
+			s = strings.TrimLeft(s, " ")
+			if s == "" {
+				return nil, s, errors.New("unterminated structured data")
+			}
+			if s[0] == ']' {
+				s = s[1:]
+				break
+			}
+
+			eq := strings.Index(s, "=\"")
+			if eq < 0 {
+				return nil, s, errors.New("invalid structured data parameter")
+			}
+			name := s[:eq]
+			value, rest, err := parseSDValue(s[eq+2:])
+			if err != nil {
+				return nil, s, err
+			}
+			params[name] = value
+			s = rest
+		}
+	}
+
+	return sd, s, nil
+}
+
+func parseSDValue(s string) (string, string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+				i++
+			}
+			b.WriteByte(s[i])
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", s, errors.New("unterminated structured data value")
+}
+
+// parseRFC3164 parses "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG", where the hostname is optional.
+func parseRFC3164(s string, now time.Time) map[string]interface{} {
+	entry := map[string]interface{}{
+		"time": now,
+	}
+
+	if t, rest, ok := parseRFC3164Time(s, now); ok {
+		entry["time"] = t
+		s = rest
+	}
+
+	token, rest, _ := nextSyslogToken(s)
+	if !isSyslogTag(token) {
+		if next, _, _ := nextSyslogToken(rest); isSyslogTag(next) {
+			entry["hostname"] = token
+			s = rest
+		}
+	}
+
+	token, rest, _ = nextSyslogToken(s)
+	if isSyslogTag(token) {
+		tag := strings.TrimSuffix(token, ":")
+		if i := strings.IndexByte(tag, '['); i >= 0 {
+			entry["procid"] = strings.TrimSuffix(tag[i+1:], "]")
+			tag = tag[:i]
+		}
+		entry["app_name"] = tag
+		s = rest
+	}
+	entry["msg"] = s
+
+	return entry
+}
+
+// parseRFC3164Time parses the timestamp, which has no year, assuming the message is not from the future.
+// Some senders add the year after the day, or use RFC 3339 timestamps instead.
+func parseRFC3164Time(s string, now time.Time) (time.Time, string, bool) {
+	if len(s) > len(stampWithYear) {
+		t, err := time.ParseInLocation(stampWithYear, s[:len(stampWithYear)], time.Local)
+		if err == nil {
+			return t, strings.TrimLeft(s[len(stampWithYear):], " "), true
+		}
+	}
+	if len(s) > len(time.Stamp) {
+		t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], time.Local)
+		if err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			return t, strings.TrimLeft(s[len(time.Stamp):], " "), true
+		}
+	}
+
+	token, rest, _ := nextSyslogToken(s)
+	t, err := time.Parse(time.RFC3339Nano, token)
+	if err != nil {
+		return time.Time{}, s, false
+	}
+
+	return t, rest, true
+}
+
+func isSyslogTag(token string) bool {
+	return strings.HasSuffix(token, ":")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name     string
+		msg      string
+		wantTime time.Time
+		want     map[string]interface{}
+	}{
+		{
+			name:     "rfc 5424 with structured data",
+			msg:      `<165>1 2003-10-11T22:14:15.003Z host.example.com evntslog 42 ID47 [exampleSDID@32473 iut="3" eventSource="Application"][meta note="a \"quoted\" \] value" path="C:\dir"] ` + "\ufeff" + "An application event",
+			wantTime: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+			want: map[string]interface{}{
+				"level":    "info",
+				"severity": "notice",
+				"facility": "local4",
+				"hostname": "host.example.com",
+				"app_name": "evntslog",
+				"procid":   "42",
+				"msgid":    "ID47",
+				"structured_data": map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": "Application"},
+					"meta":              {"note": `a "quoted" ] value`, "path": `C:\dir`},
+				},
+				"msg": "An application event",
+			},
+		},
+		{
+			name:     "rfc 5424 with nil values",
+			msg:      "<34>1 - - - - - - su failed",
+			wantTime: now,
+			want: map[string]interface{}{
+				"level":    "fatal",
+				"severity": "crit",
+				"facility": "auth",
+				"msg":      "su failed",
+			},
+		},
+		{
+			name:     "rfc 5424 without message",
+			msg:      "<0>1 2003-10-11T22:14:15Z - - - - [a b=\"c\"]",
+			wantTime: time.Date(2003, 10, 11, 22, 14, 15, 0, time.UTC),
+			want: map[string]interface{}{
+				"level":           "panic",
+				"severity":        "emerg",
+				"facility":        "kern",
+				"structured_data": map[string]map[string]string{"a": {"b": "c"}},
+				"msg":             "",
+			},
+		},
+		{
+			name:     "rfc 5424 with unterminated structured data",
+			msg:      `<14>1 2003-10-11T22:14:15Z host app - - [a b="c] msg`,
+			wantTime: now,
+			want: map[string]interface{}{
+				"level":    "info",
+				"severity": "info",
+				"facility": "user",
+				"msg":      `1 2003-10-11T22:14:15Z host app - - [a b="c] msg`,
+			},
+		},
+		{
+			name:     "rfc 3164",
+			msg:      "<38>Dec 31 23:59:58 host sshd[1234]: Accepted publickey\n",
+			wantTime: time.Date(2023, 12, 31, 23, 59, 58, 0, time.Local),
+			want: map[string]interface{}{
+				"level":    "info",
+				"severity": "info",
+				"facility": "auth",
+				"hostname": "host",
+				"app_name": "sshd",
+				"procid":   "1234",
+				"msg":      "Accepted publickey",
+			},
+		},
+		{
+			name:     "rfc 3164 with a year",
+			msg:      "<191>Mar  2 2022 10:00:00 router kernel: link up",
+			wantTime: time.Date(2022, 3, 2, 10, 0, 0, 0, time.Local),
+			want: map[string]interface{}{
+				"level":    "debug",
+				"severity": "debug",
+				"facility": "local7",
+				"hostname": "router",
+				"app_name": "kernel",
+				"msg":      "link up",
+			},
+		},
+		{
+			name:     "rfc 3164 with an rfc 3339 timestamp and no hostname",
+			msg:      "<11>2003-10-11T22:14:15+02:00 cron: job done",
+			wantTime: time.Date(2003, 10, 11, 20, 14, 15, 0, time.UTC),
+			want: map[string]interface{}{
+				"level":    "error",
+				"severity": "err",
+				"facility": "user",
+				"app_name": "cron",
+				"msg":      "job done",
+			},
+		},
+		{
+			name:     "rfc 3164 without header",
+			msg:      "<13>just a message",
+			wantTime: now,
+			want: map[string]interface{}{
+				"level":    "info",
+				"severity": "notice",
+				"facility": "user",
+				"msg":      "just a message",
+			},
+		},
+		{
+			name:     "invalid priority",
+			msg:      "<192>1 - - - - - - msg",
+			wantTime: now,
+			want: map[string]interface{}{
+				"level": "info",
+				"msg":   "<192>1 - - - - - - msg",
+			},
+		},
+		{
+			name:     "missing priority",
+			msg:      "plain message",
+			wantTime: now,
+			want: map[string]interface{}{
+				"level": "info",
+				"msg":   "plain message",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := parseSyslog([]byte(test.msg), now)
+
+			if got, ok := entry["time"].(time.Time); !ok || !got.Equal(test.wantTime) {
+				t.Errorf("time = %v, want %v", entry["time"], test.wantTime)
+			}
+			delete(entry, "time")
+			if !reflect.DeepEqual(entry, test.want) {
+				t.Errorf("entry = %v, want %v", entry, test.want)
+			}
+		})
+	}
+
+	if entry := parseSyslog([]byte(" \r\n"), now); entry != nil {
+		t.Errorf("entry of an empty message = %v, want nil", entry)
+	}
+}
+
+func TestParseStructuredData(t *testing.T) {
+	tests := []struct {
+		input    string
+		want     map[string]map[string]string
+		wantRest string
+		wantErr  bool
+	}{
+		{input: "- msg", wantRest: " msg"},
+		{input: "-", wantRest: ""},
+		{input: "[id] msg", want: map[string]map[string]string{"id": {}}, wantRest: " msg"},
+		{
+			input:    `[a x="1" y=""][b z="\\ \" \]"] msg`,
+			want:     map[string]map[string]string{"a": {"x": "1", "y": ""}, "b": {"z": `\ " ]`}},
+			wantRest: " msg",
+		},
+		{input: `[a x="\n"]`, want: map[string]map[string]string{"a": {"x": `\n`}}},
+		{input: `[a x="1"`, wantErr: true},
+		{input: `[a x=1]`, wantErr: true},
+		{input: `[a x="1]`, wantErr: true},
+		{input: `[a`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, rest, err := parseStructuredData(test.input)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseStructuredData(%q) error = %v, want error: %t", test.input, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) || rest != test.wantRest {
+			t.Errorf("parseStructuredData(%q) = %v, %q, want %v, %q", test.input, got, rest, test.want, test.wantRest)
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "newline framing",
+			input: "<13>first\n<13>second\n<13>last",
+			want:  []string{"<13>first\n", "<13>second\n", "<13>last"},
+		},
+		{
+			name:  "octet counting",
+			input: "9 <13>first11 <13>second\n",
+			want:  []string{"<13>first", "<13>second\n"},
+		},
+		{
+			name:    "invalid octet count",
+			input:   "12x <13>first",
+			wantErr: true,
+		},
+		{
+			name:    "octet count over the maximum",
+			input:   "99999999 <13>first",
+			wantErr: true,
+		},
+		{
+			name:    "truncated frame",
+			input:   "20 <13>first",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(test.input))
+
+			got := []string{}
+			var err error
+			for {
+				var frame []byte
+				frame, err = readSyslogFrame(r)
+				if err != nil {
+					break
+				}
+				got = append(got, string(frame))
+			}
+
+			if test.wantErr {
+				if err == nil || err == io.EOF {
+					t.Errorf("error = %v, want a framing error", err)
+				}
+				return
+			}
+			if err != io.EOF {
+				t.Errorf("error = %v, want EOF", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("frames = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
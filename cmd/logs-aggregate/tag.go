@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// tagLine adds fields to a JSON line, without overriding the fields already present.
+// Lines that are not JSON objects are wrapped, with the original text in "msg".
+func tagLine(line string, fields map[string]interface{}) string {
+	var entry map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(line), &entry)
+	if err != nil || entry == nil {
+		msg, _ := json.Marshal(line)
+		entry = map[string]json.RawMessage{
+			"msg": msg,
+		}
+	}
+
+	for k, v := range fields {
+		if _, ok := entry[k]; ok {
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		entry[k] = b
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return line
+	}
+
+	return string(b)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tidwall/gjson"
+)
+
+// FollowPollInterval is how often the followed files are checked for new lines once read to the end.
+var FollowPollInterval = 250 * time.Millisecond
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	errCaughtUp = errors.New("caught up")
+)
+
+// Input is a source of lines: stdin, or a file whose lines are tagged with its name in the _file field.
+type Input struct {
+	Name string
+	io.ReadCloser
+	// Live inputs are not merged by time with the other inputs, their lines are inserted as they come.
+	Live bool
+}
+
+func stdinInput() Input {
+	return Input{
+		ReadCloser: os.Stdin,
+		Live:       true,
+	}
+}
+
+// OpenInputs opens the files, "-" being stdin. Gzip and zstd files are decompressed. When following, the
+// other files are read until stop is closed, including through truncation, and their reads return
+// errCaughtUp once when first reaching their end.
+func OpenInputs(paths []string, follow bool, stop <-chan struct{}) ([]Input, error) {
+	inputs := make([]Input, 0, len(paths))
+	for _, path := range paths {
+		if path == "-" {
+			inputs = append(inputs, stdinInput())
+			continue
+		}
+
+		input, err := openInput(path, follow, stop)
+		if err != nil {
+			closeInputs(inputs)
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+
+	return inputs, nil
+}
+
+func openInput(path string, follow bool, stop <-chan struct{}) (Input, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Input{}, err
+	}
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		_ = f.Close()
+		return Input{}, err
+	}
+	magic = magic[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return Input{}, err
+	}
+
+	input := Input{
+		Name:       path,
+		ReadCloser: f,
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		r, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			_ = f.Close()
+			return Input{}, fmt.Errorf("opening %s: %v", path, err)
+		}
+		input.ReadCloser = readCloser{r, func() error {
+			_ = r.Close()
+			return f.Close()
+		}}
+	case bytes.HasPrefix(magic, zstdMagic):
+		r, err := zstd.NewReader(bufio.NewReader(f))
+		if err != nil {
+			_ = f.Close()
+			return Input{}, fmt.Errorf("opening %s: %v", path, err)
+		}
+		input.ReadCloser = readCloser{r, func() error {
+			r.Close()
+			return f.Close()
+		}}
+	case follow:
+		input.ReadCloser = &followReader{
+			f:    f,
+			stop: stop,
+		}
+	}
+
+	return input, nil
+}
+
+func closeInputs(inputs []Input) {
+	for _, input := range inputs {
+		_ = input.Close()
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// followReader reads a file as it grows, like `tail -f`, starting over when the file is truncated.
+type followReader struct {
+	f        *os.File
+	offset   int64
+	caughtUp bool
+	stop     <-chan struct{}
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != io.EOF {
+			return n, err
+		}
+		if !r.caughtUp {
+			r.caughtUp = true
+			return 0, errCaughtUp
+		}
+
+		if fi, err := r.f.Stat(); err == nil && fi.Size() < r.offset {
+			if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+			r.offset = 0
+			continue
+		}
+
+		select {
+		case <-r.stop:
+			return 0, io.EOF
+		case <-time.After(FollowPollInterval):
+		}
+	}
+}
+
+func (r *followReader) Close() error {
+	return r.f.Close()
+}
+
+// tagFile adds the name of the file a line comes from to the line, converting it to JSON if needed.
+func tagFile(line []byte, name string) []byte {
+	var entry map[string]json.RawMessage
+
+	err := json.Unmarshal(line, &entry)
+	if err != nil || entry == nil {
+		msg, _ := json.Marshal(string(line))
+		entry = map[string]json.RawMessage{
+			"msg": msg,
+		}
+	}
+	if _, ok := entry["_file"]; ok {
+		return line
+	}
+	entry["_file"], _ = json.Marshal(name)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return line
+	}
+
+	return b
+}
+
+type mergeHead struct {
+	lines <-chan []byte
+	line  []byte
+	time  time.Time
+}
+
+// next receives the next line of the input, returning false once the input is closed or caught up.
+func (h *mergeHead) next() bool {
+	line, ok := <-h.lines
+	if !ok || line == nil {
+		return false
+	}
+
+	h.line = line
+	if t, err := time.Parse(time.RFC3339Nano, gjson.GetBytes(line, "time").Str); err == nil {
+		h.time = t
+	}
+
+	return true
+}
+
+// mergeInputs sends the lines of the inputs to out, ordered by their time field until each input is closed
+// or caught up, then as they come. Lines without a time keep their place among the lines of their input.
+// The live inputs, which send a nil line right away, and the inputs once caught up are not held back by the
+// merge: their lines are sent as they come, interleaved with the merged lines.
+func mergeInputs(inputs []<-chan []byte, out chan<- []byte, stop <-chan struct{}) {
+	wg := &sync.WaitGroup{}
+	defer func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	forward := func(lines <-chan []byte) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for line := range lines {
+				if line == nil {
+					continue
+				}
+				select {
+				case out <- line:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	heads := make([]*mergeHead, 0, len(inputs))
+	for _, lines := range inputs {
+		h := &mergeHead{
+			lines: lines,
+		}
+		if h.next() {
+			heads = append(heads, h)
+		} else {
+			forward(lines)
+		}
+	}
+
+	for len(heads) > 0 {
+		first := 0
+		for i, h := range heads {
+			if h.time.Before(heads[first].time) {
+				first = i
+			}
+		}
+
+		h := heads[first]
+		select {
+		case out <- h.line:
+		case <-stop:
+			return
+		}
+		if !h.next() {
+			forward(h.lines)
+			heads = append(heads[:first], heads[first+1:]...)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	FollowPollInterval = 10 * time.Millisecond
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "logs-dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func writeFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenInputs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	content := "{\"msg\":\"a\"}\n{\"msg\":\"b\"}\n"
+
+	gz := &bytes.Buffer{}
+	gw := gzip.NewWriter(gz)
+	_, _ = gw.Write([]byte(content))
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := zw.EncodeAll([]byte(content), nil)
+	_ = zw.Close()
+
+	files := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"plain.log", []byte(content), content},
+		{"compressed.log.gz", gz.Bytes(), content},
+		{"compressed.log.zst", zst, content},
+		// shorter than the magic bytes
+		{"short.log", []byte("a"), "a"},
+		{"empty.log", nil, ""},
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = filepath.Join(dir, f.name)
+		writeFile(t, paths[i], f.content)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	inputs, err := OpenInputs(paths, false, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeInputs(inputs)
+
+	for i, input := range inputs {
+		if input.Name != paths[i] || input.Live {
+			t.Errorf("input %d = %q (live: %t), want %q", i, input.Name, input.Live, paths[i])
+		}
+		b, err := ioutil.ReadAll(input)
+		if err != nil {
+			t.Errorf("reading %s: %v", files[i].name, err)
+			continue
+		}
+		if string(b) != files[i].want {
+			t.Errorf("%s = %q, want %q", files[i].name, b, files[i].want)
+		}
+	}
+
+	if _, err := OpenInputs([]string{paths[0], filepath.Join(dir, "missing.log")}, false, stop); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	// a gzip file whose header is invalid
+	writeFile(t, paths[1], []byte{0x1f, 0x8b, 0})
+	if _, err := OpenInputs(paths[1:2], false, stop); err == nil {
+		t.Error("expected an error for an invalid gzip file")
+	}
+}
+
+// readFollowed reads from r until it returns n bytes or an error.
+func readFollowed(t *testing.T, r io.Reader, n int) (string, error) {
+	t.Helper()
+
+	type result struct {
+		b   string
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		b := make([]byte, 0, n)
+		p := make([]byte, n)
+		for len(b) < n {
+			m, err := r.Read(p[:n-len(b)])
+			b = append(b, p[:m]...)
+			if err != nil {
+				results <- result{string(b), err}
+				return
+			}
+		}
+		results <- result{string(b), nil}
+	}()
+
+	select {
+	case r := <-results:
+		return r.b, r.err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out reading the followed file")
+		return "", nil
+	}
+}
+
+func TestFollowReader(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	writeFile(t, path, []byte("a\n"))
+
+	stop := make(chan struct{})
+	inputs, err := OpenInputs([]string{path}, true, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeInputs(inputs)
+	input := inputs[0]
+
+	if got, err := readFollowed(t, input, 2); got != "a\n" || err != nil {
+		t.Fatalf("read %q, %v, want %q", got, err, "a\n")
+	}
+	if got, err := readFollowed(t, input, 2); got != "" || err != errCaughtUp {
+		t.Fatalf("read %q, %v at the end of the file, want %v", got, err, errCaughtUp)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("b\n")
+	_ = f.Close()
+	if got, err := readFollowed(t, input, 2); got != "b\n" || err != nil {
+		t.Fatalf("read %q, %v, want the appended line", got, err)
+	}
+
+	// truncated, the file is read from the start
+	writeFile(t, path, []byte("c\n"))
+	if got, err := readFollowed(t, input, 2); got != "c\n" || err != nil {
+		t.Fatalf("read %q, %v, want the line written after the truncation", got, err)
+	}
+
+	close(stop)
+	if got, err := readFollowed(t, input, 2); got != "" || err != io.EOF {
+		t.Errorf("read %q, %v once stopped, want %v", got, err, io.EOF)
+	}
+}
+
+func TestTagFile(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"msg":"a","level":"info"}`, `{"_file":"app.log","level":"info","msg":"a"}`},
+		{"plain text", `{"_file":"app.log","msg":"plain text"}`},
+		{`{"msg":"a","_file":"other.log"}`, `{"msg":"a","_file":"other.log"}`},
+		{`["not","an","object"]`, `{"_file":"app.log","msg":"[\"not\",\"an\",\"object\"]"}`},
+	}
+
+	for _, test := range tests {
+		if got := string(tagFile([]byte(test.line), "app.log")); got != test.want {
+			t.Errorf("tagFile(%s) = %s, want %s", test.line, got, test.want)
+		}
+	}
+}
+
+func timedLine(seconds int, msg string) []byte {
+	t := time.Date(2024, 1, 1, 12, 0, seconds, 0, time.UTC).Format(time.RFC3339Nano)
+
+	return []byte(`{"time":"` + t + `","msg":"` + msg + `"}`)
+}
+
+func sendLines(lines ...[]byte) <-chan []byte {
+	ch := make(chan []byte, len(lines))
+	for _, line := range lines {
+		ch <- line
+	}
+	close(ch)
+
+	return ch
+}
+
+func TestMergeInputs(t *testing.T) {
+	inputs := []<-chan []byte{
+		sendLines(timedLine(1, "a1"), timedLine(4, "a4"), []byte(`{"msg":"a no time"}`), timedLine(5, "a5")),
+		sendLines(timedLine(2, "b2"), timedLine(3, "b3"), timedLine(6, "b6")),
+	}
+	out := make(chan []byte)
+	stop := make(chan struct{})
+	defer close(stop)
+	go mergeInputs(inputs, out, stop)
+
+	got := []string{}
+	for line := range out {
+		got = append(got, string(line))
+	}
+	want := []string{
+		string(timedLine(1, "a1")),
+		string(timedLine(2, "b2")),
+		string(timedLine(3, "b3")),
+		string(timedLine(4, "a4")),
+		`{"msg":"a no time"}`,
+		string(timedLine(5, "a5")),
+		string(timedLine(6, "b6")),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestMergeInputsLive(t *testing.T) {
+	// the file is still being read, its next line is not there yet
+	file := make(chan []byte, 1)
+	file <- timedLine(1, "file")
+	live := make(chan []byte, 2)
+	live <- nil
+	out := make(chan []byte)
+	stop := make(chan struct{})
+	defer close(stop)
+	go mergeInputs([]<-chan []byte{file, live}, out, stop)
+
+	receive := func() string {
+		t.Helper()
+		select {
+		case line := <-out:
+			return string(line)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a line")
+			return ""
+		}
+	}
+
+	if got, want := receive(), string(timedLine(1, "file")); got != want {
+		t.Errorf("line = %s, want %s", got, want)
+	}
+	live <- []byte(`{"msg":"live"}`)
+	if got := receive(); got != `{"msg":"live"}` {
+		t.Errorf("line = %s, want the live line before the end of the file", got)
+	}
+
+	file <- timedLine(2, "file")
+	close(file)
+	close(live)
+	if got, want := receive(), string(timedLine(2, "file")); got != want {
+		t.Errorf("line = %s, want %s", got, want)
+	}
+	if line, ok := <-out; ok {
+		t.Errorf("unexpected line %s", line)
+	}
+}
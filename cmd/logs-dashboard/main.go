@@ -3,9 +3,17 @@ package main
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"runtime/pprof"
 	"strings"
-
+	"time"
+
+	"github.com/Pimmr/logs-dashboard/internal/filter"
+	"github.com/Pimmr/logs-dashboard/internal/flags"
+	"github.com/Pimmr/logs-dashboard/internal/grok"
+	"github.com/Pimmr/logs-dashboard/internal/multiline"
+	"github.com/Pimmr/logs-dashboard/internal/normalize"
+	"github.com/Pimmr/logs-dashboard/internal/redact"
 	"github.com/Pimmr/rig"
 	"github.com/Pimmr/rig/validators"
 	"golang.org/x/crypto/ssh/terminal"
@@ -16,6 +24,14 @@ var (
 
 )
 
+const noInputText = `No logs to show.
+
+Pipe logs into logs-dashboard:
+  logs-aggregate -deploy api -follow | logs-dashboard
+
+or give it files to open (plain, gzip or zstd, "-" for stdin):
+  logs-dashboard api.json worker.log.gz`
+
 // TODO:
 // - [ ] Search / Highlight
 // - [ ] Add toggle to show stacktraces on multiple lines
@@ -32,10 +48,21 @@ func main() {
 		initialFilter    string
 		stacktrace       bool
 		maxSort          = 200
+		format           = string(normalize.Auto)
+		patterns         flags.Strings
+		multilineNames   []string
+		multilineStart   *regexp.Regexp
+		multilineTimeout = time.Second
+		follow           bool
+		redactDetectors  []string
+		redactFields     []string
+		redactValues     flags.Strings
+		redactHash       bool
+		redactHashKey    string
 	)
 
 	stop := make(chan struct{})
-	flags := &rig.Config{
+	conf := &rig.Config{
 		FlagSet: rig.DefaultFlagSet(),
 		Flags: []*rig.Flag{
 			rig.Repeatable(&exclude, rig.StringGenerator(), "exclude", "EXCLUDE", "hide keys"),
@@ -48,15 +75,69 @@ func main() {
 			rig.String(&initialFilter, "filter", "INITIAL_FILTER", "initial filter"),
 			rig.Bool(&stacktrace, "stacktrace", "STACKTRACE", "expand stack traces"),
 			rig.Int(&maxSort, "max-sort", "MAX_SORT", "maximum number of entries to sort", validators.IntMin(2)),
+			rig.String(&format, "format", "FORMAT", "format of the lines, rewritten to the logrus keys: auto, none, logrus, zap, zerolog, bunyan, ecs, gcp or logfmt"),
+			rig.Var(&patterns, "grok", "GROK", "convert the raw lines matching these patterns to JSON: grok expressions, regexps with named groups, or built-in patterns (COMMONAPACHELOG, COMBINEDAPACHELOG, NGINXACCESS, ENVOYACCESS)"),
+			rig.Repeatable(&multilineNames, rig.StringGenerator(), "multiline", "MULTILINE", "join the lines of plain-text stack traces into the stacktrace field of the line before them: java, python or go"),
+			rig.Regexp(&multilineStart, "multiline-start", "MULTILINE_START", "join the lines not matching this regexp into the stacktrace field of the line before them"),
+			rig.Duration(&multilineTimeout, "multiline-timeout", "MULTILINE_TIMEOUT", "how long to wait for more lines of a multi-line event"),
+			rig.Bool(&follow, "follow", "FOLLOW", "follow the files as they grow (compressed files are read once)"),
+			rig.Repeatable(&redactDetectors, rig.StringGenerator(), "redact", "REDACT", "redact the values found by these detectors: jwt, email or card"),
+			rig.Repeatable(&redactFields, rig.StringGenerator(), "redact-fields", "REDACT_FIELDS", "redact the values of the fields matching these patterns, ignoring case (i.e. '*password*', 'authorization' or 'user.email')"),
+			rig.Var(&redactValues, "redact-values", "REDACT_VALUES", "redact the parts of the values matching these regexps"),
+			rig.Bool(&redactHash, "redact-hash", "REDACT_HASH", "replace the redacted values with a keyed hash of the value rather than a mask, so that entries can still be correlated"),
+			rig.String(&redactHashKey, "redact-hash-key", "REDACT_HASH_KEY", "key of the redaction hashes, required with -redact-hash"),
 		},
 	}
-	err := flags.Parse(os.Args[1:])
+	err := conf.Parse(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	logFormat, err := normalize.ParseFormat(format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	grokPatterns, err := grok.CompileAll(patterns)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	detectors, err := multiline.ParseDetectors(multilineNames)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(2)
 	}
-	if terminal.IsTerminal(int(os.Stdin.Fd())) {
-		os.Stdin, _ = os.Open("/dev/null")
+	multilineConf := multiline.Config{
+		Start:     multilineStart,
+		Detectors: detectors,
+		Timeout:   multilineTimeout,
+	}
+	redactor, err := redact.New(redact.Config{
+		Fields:    redactFields,
+		Values:    redactValues,
+		Detectors: redactDetectors,
+		Hash:      redactHash,
+		HashKey:   redactHashKey,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	inputs, err := OpenInputs(conf.FlagSet.Args(), follow, stop)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(inputs) == 0 {
+		if terminal.IsTerminal(int(os.Stdin.Fd())) {
+			err = ShowError(noInputText)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+			os.Exit(2)
+		}
+		inputs = append(inputs, stdinInput())
 	}
 
 	if cpuProfile != "" {
@@ -82,25 +163,23 @@ func main() {
 		Key:     lookupKey,
 		IFS:     lookupKeyIFS,
 		Exclude: lookupKeyExclude,
-	}, maxSort)
+	}, maxSort, redactor)
 
-	filter := NewFilter(messageKeys)
+	lineFilter := filter.New(messageKeys)
 	if initialFilter != "" {
-		filter.Set(initialFilter)
+		lineFilter.Set(initialFilter)
 	}
-	store.AddKnownFields(filter.Keywords()...)
+	store.AddKnownFields(lineFilter.Keywords()...)
 	store.AddKnownFields("raw")
 
 	prettifier := NewPrettifier(exclude, durations, messageKeys, stacktrace)
 	filterHistory := NewHistory(loadFilterHistory())
 	excludeHistory := NewHistory(loadExcludeHistory(strings.Join(prettifier.GetFilterFields(), ",")))
 
-	done := streamToStore(os.Stdin, store, stop)
-	defer func() {
-		_ = os.Stdin.Close()
-	}()
+	done := streamToStore(inputs, store, grokPatterns, logFormat, multilineConf, stop)
+	defer closeInputs(inputs)
 
-	ui := NewUI(store, filter, prettifier, filterHistory, excludeHistory)
+	ui := NewUI(store, lineFilter, prettifier, filterHistory, excludeHistory)
 	err = ui.Run()
 	close(stop)
 	stopMonitoredProcess(store)
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +12,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Pimmr/logs-dashboard/internal/grok"
+	"github.com/Pimmr/logs-dashboard/internal/multiline"
+	"github.com/Pimmr/logs-dashboard/internal/normalize"
+	"github.com/Pimmr/logs-dashboard/internal/redact"
 	"github.com/tidwall/gjson"
 )
 
@@ -53,9 +56,10 @@ type Store struct {
 	filterCache map[string]map[uint64][]byte
 	m           *sync.RWMutex
 	pid         int
+	redactor    *redact.Redactor
 }
 
-func NewStore(lookupKey LookupKey, maxSort int) *Store {
+func NewStore(lookupKey LookupKey, maxSort int, redactor *redact.Redactor) *Store {
 	return &Store{
 		entries:     make([]*Entry, 0, StoreGrowingIncr),
 		cache:       make(map[uint64]*Entry, StoreGrowingIncr),
@@ -65,6 +69,7 @@ func NewStore(lookupKey LookupKey, maxSort int) *Store {
 		filterCache: map[string]map[uint64][]byte{},
 		m:           &sync.RWMutex{},
 		pid:         -1,
+		redactor:    redactor,
 	}
 }
 
@@ -169,6 +174,8 @@ func (store *Store) LookupKey() LookupKey {
 }
 
 func (store *Store) Insert(line []byte) {
+	line = store.redactor.Redact(line)
+
 	store.m.Lock()
 	defer store.m.Unlock()
 	if len(store.entries)+1 >= cap(store.entries) {
@@ -358,7 +365,8 @@ func (store *Store) Paused() bool {
 	return store.paused >= 0
 }
 
-func streamToStore(r io.Reader, store *Store, stop <-chan struct{}) (done <-chan struct{}) {
+// streamToStore inserts the lines of the inputs into the store, merged by time (see mergeInputs).
+func streamToStore(inputs []Input, store *Store, patterns grok.Patterns, format normalize.Format, multilineConf multiline.Config, stop <-chan struct{}) (done <-chan struct{}) {
 	doneCh := make(chan struct{})
 
 	bb := make([][]byte, 0, StoreGrowingIncr)
@@ -384,51 +392,113 @@ func streamToStore(r io.Reader, store *Store, stop <-chan struct{}) (done <-chan
 		}
 	}()
 
+	inputLines := make([]<-chan []byte, 0, len(inputs))
+	for _, input := range inputs {
+		lines := make(chan []byte, StoreGrowingIncr)
+		inputLines = append(inputLines, lines)
+		go readInput(input, patterns, format, multilineConf, lines, stop)
+	}
+	merged := make(chan []byte)
+	go mergeInputs(inputLines, merged, stop)
+
 	go func() {
-		buf := bufio.NewReader(r)
-		for {
-			lineCh := make(chan Line)
-			go func() {
-				b, err := buf.ReadBytes('\n')
-				lineCh <- Line{
-					B:   b,
-					Err: err,
-				}
-			}()
-			var line Line
-			select {
-			case line = <-lineCh:
-			case <-stop:
-				close(doneCh)
-				return
-			}
-			if line.Err == io.EOF {
-				break
-			}
-			if line.Err != nil {
-				fmt.Fprintf(os.Stderr, "Error: reading line from reader: %v\n", line.Err)
-				break
-			}
-			line.B = bytes.TrimSpace(line.B)
-			if len(line.B) == 0 {
-				continue
-			}
+		defer close(doneCh)
 
+		for line := range merged {
 			bbM.Lock()
 			if len(bb)+1 >= cap(bb) {
 				newBuf := make([][]byte, len(bb), cap(bb)+StoreGrowingIncr)
 				copy(newBuf, bb)
 				bb = newBuf
 			}
-			bb = append(bb, line.B)
+			bb = append(bb, line)
 			bbM.Unlock()
 		}
-		close(doneCh)
 	}()
 
 	return doneCh
 }
 
+// readInput sends the lines of the input to lines, parsed, normalized and joined, until its end or until stop
+// is closed. A nil line is sent when the input is caught up (see OpenInputs), or right away for live inputs.
+func readInput(input Input, patterns grok.Patterns, format normalize.Format, multilineConf multiline.Config, lines chan<- []byte, stop <-chan struct{}) {
+	defer close(lines)
+
+	send := func(line []byte) bool {
+		select {
+		case lines <- line:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	if input.Live && !send(nil) {
+		return
+	}
+
+	normalizer := normalize.New(format)
+	joiner := multiline.NewJoiner(multilineConf, func(event multiline.Event) {
+		line := event.Line
+		if b, ok := patterns.Parse(line); ok {
+			line = b
+		}
+		line = multiline.Fold(normalizer.Normalize(line), event.Stacktrace)
+		if input.Name != "" {
+			line = tagFile(line, input.Name)
+		}
+		send(line)
+	})
+	defer joiner.Close()
+
+	buf := bufio.NewReader(input)
+	var partial []byte
+	for {
+		lineCh := make(chan Line)
+		go func() {
+			b, err := buf.ReadBytes('\n')
+			lineCh <- Line{
+				B:   b,
+				Err: err,
+			}
+		}()
+		var line Line
+		select {
+		case line = <-lineCh:
+		case <-stop:
+			return
+		}
+		if line.Err == errCaughtUp {
+			partial = append(partial, line.B...)
+			joiner.Flush()
+			if !send(nil) {
+				return
+			}
+			continue
+		}
+		if len(partial) > 0 {
+			line.B = append(partial, line.B...)
+			partial = nil
+		}
+		if line.Err == io.EOF {
+			joiner.Add(string(line.B))
+			return
+		}
+		if line.Err != nil {
+			fmt.Fprintf(os.Stderr, "Error: reading line from %s: %v\n", inputName(input), line.Err)
+			return
+		}
+		joiner.Add(string(line.B))
+	}
+}
+
+func inputName(input Input) string {
+	if input.Name == "" {
+		return "stdin"
+	}
+
+	return input.Name
+}
+
 func fields(b []byte) ([]string, int, time.Time, error) {
 	var (
 		v map[string]json.RawMessage
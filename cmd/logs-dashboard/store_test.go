@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Pimmr/logs-dashboard/internal/multiline"
+	"github.com/Pimmr/logs-dashboard/internal/normalize"
+)
+
+// readAll returns the lines read from the input by readInput, without the nil lines.
+func readAll(input Input, format normalize.Format) []string {
+	lines := make(chan []byte, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go readInput(input, nil, format, multiline.Config{}, lines, stop)
+
+	got := []string{}
+	for line := range lines {
+		if line != nil {
+			got = append(got, string(line))
+		}
+	}
+
+	return got
+}
+
+func TestReadInput(t *testing.T) {
+	input := Input{
+		ReadCloser: ioutil.NopCloser(strings.NewReader(
+			`time=2020-09-13T12:26:40Z level=warn msg="disk full" free=0` + "\n" +
+				`{"ts":1600000000,"level":"info","msg":"zap"}` + "\n" +
+				"plain text with a=pair\n",
+		)),
+		Live: true,
+	}
+
+	got := readAll(input, normalize.Auto)
+	want := []string{
+		`{"time":"2020-09-13T12:26:40Z","level":"warn","msg":"disk full","free":0}`,
+		`{"ts":1600000000,"level":"info","msg":"zap","time":"2020-09-13T12:26:40Z"}`,
+		"plain text with a=pair",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
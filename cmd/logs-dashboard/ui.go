@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Pimmr/logs-dashboard/internal/filter"
 	"github.com/gdamore/tcell"
 	"github.com/rivo/tview"
 )
@@ -68,7 +69,7 @@ type UI struct {
 }
 
 //nolint
-func NewUI(store *Store, filter *Filter, prettifier *Prettifier, filterHistory, excludeHistory *History) *UI {
+func NewUI(store *Store, filter *filter.Filter, prettifier *Prettifier, filterHistory, excludeHistory *History) *UI {
 	var lastFilterTime time.Duration
 
 	var selectedID uint64
@@ -686,6 +687,28 @@ func (ui *UI) Run() error {
 	return ui.app.Run()
 }
 
+// ShowError shows an error screen in place of the dashboard, until it is dismissed.
+func ShowError(text string) error {
+	app := tview.NewApplication()
+
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Quit"}).
+		SetDoneFunc(func(int, string) {
+			app.Stop()
+		})
+	modal.SetBackgroundColor(BackgroundColor)
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape || event.Rune() == 'q' {
+			app.Stop()
+			return nil
+		}
+		return event
+	})
+
+	return app.SetRoot(modal, false).Run()
+}
+
 func entriesToBytes(prettifier *Prettifier, entries []*Entry, selected int) [][]byte {
 	ret := make([][]byte, len(entries))
 
@@ -1,4 +1,5 @@
-package main
+// Package filter implements the jsonql filters shared by logs-aggregate and logs-dashboard.
+package filter
 
 import (
 	"strings"
@@ -7,13 +8,16 @@ import (
 	"github.com/elgs/jsonql"
 )
 
+// Filter matches JSON lines against a list of jsonql queries separated by ';', a line matching if any query
+// matches. Besides the fields of the line, queries can use the pseudo-fields raw (the line itself), _id and
+// _msg (the first of the message keys present). Lines that are not JSON can only be matched with raw.
 type Filter struct {
 	queries     []string
 	messageKeys []string
 	m           *sync.Mutex
 }
 
-func NewFilter(messageKeys []string) *Filter {
+func New(messageKeys []string) *Filter {
 	return &Filter{
 		messageKeys: messageKeys,
 		m:           &sync.Mutex{},
@@ -51,12 +55,27 @@ func (f *Filter) Set(q string) {
 	f.queries = qq
 }
 
-func (f *Filter) Execute(id uint64, b []byte) (_ []byte, returnErr error) {
+// Validate returns an error if the queries cannot be evaluated. jsonql is lenient, so this only catches some
+// invalid queries.
+func (f *Filter) Validate() error {
+	_, err := f.Execute(0, []byte("{}"))
+
+	return err
+}
+
+// Execute returns b if it matches the queries, or nil otherwise.
+func (f *Filter) Execute(id uint64, b []byte) ([]byte, error) {
+	return f.ExecuteTagged(id, b, b)
+}
+
+// ExecuteTagged is like Execute, but matches the queries against tagged, a copy of b with extra fields.
+// The raw pseudo-field is still b.
+func (f *Filter) ExecuteTagged(id uint64, b, tagged []byte) ([]byte, error) {
 	if len(f.queries) == 0 {
 		return b, nil
 	}
 
-	parser, err := jsonql.NewStringQuery(string(b))
+	parser, err := jsonql.NewStringQuery(string(tagged))
 	if err != nil {
 		parser = jsonql.NewQuery(map[string]interface{}{
 			"raw": string(b),
@@ -0,0 +1,20 @@
+// Package flags holds the flag types shared by the commands.
+package flags
+
+import (
+	"strings"
+)
+
+// Strings is a repeated flag. Unlike the slice flags of rig, the values are not split on commas, so that they
+// can hold commands, regexps or patterns.
+type Strings []string
+
+func (s Strings) String() string {
+	return strings.Join(s, "; ")
+}
+
+func (s *Strings) Set(v string) error {
+	*s = append(*s, v)
+
+	return nil
+}
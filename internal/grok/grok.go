@@ -0,0 +1,293 @@
+// Package grok extracts fields from unstructured lines, such as access logs, using grok expressions
+// (%{PATTERN:field:type}) or regular expressions with named groups.
+package grok
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxDepth = 16
+
+// Builtins are the named patterns available in grok expressions. The access log patterns set the time, status,
+// bytes and duration fields, from which the parsers derive the level.
+var Builtins = map[string]string{
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d*)?|\.\d+)`,
+	"BASE16NUM":         `(?:0[xX])?[0-9A-Fa-f]+`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"USER":              `[a-zA-Z0-9._-]+`,
+	"IPV4":              `(?:\d{1,3}\.){3}\d{1,3}`,
+	"IPV6":              `[0-9A-Fa-f:]*:[0-9A-Fa-f:.]+(?:%\w+)?`,
+	"IP":                `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME":          `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":          `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT":          `%{IPORHOST}:\d+`,
+	"QS":                `"(?:[^"\\]|\\.)*"`,
+	"QUOTEDSTRING":      `%{QS}`,
+	"PATH":              `(?:/[^\s?#]*)+`,
+	"URIPATHPARAM":      `\S+`,
+	"HTTPDATE":          `\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(?::?\d{2}(?:[.,]\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|panic)`,
+
+	"COMMONAPACHELOG":   `%{IPORHOST:client} %{USER:ident} %{USER:auth} \[%{HTTPDATE:time}\] "(?:%{WORD:method} %{NOTSPACE:path}(?: HTTP/%{NUMBER:http_version})?|%{DATA:request})" %{INT:status:int} (?:%{INT:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} "%{DATA:referrer}" "%{DATA:user_agent}"`,
+	"NGINXACCESS":       `%{COMBINEDAPACHELOG}(?: "%{DATA:forwarded_for}")?(?: %{NUMBER:duration:float})?`,
+	"ENVOYACCESS":       `\[%{TIMESTAMP_ISO8601:time}\] "%{WORD:method} %{NOTSPACE:path} %{NOTSPACE:protocol}" %{INT:status:int} %{NOTSPACE:response_flags} %{INT:bytes_received:int} %{INT:bytes:int} %{INT:duration_ms:int} (?:%{INT:upstream_service_time_ms:int}|-) "%{DATA:forwarded_for}" "%{DATA:user_agent}" "%{DATA:request_id}" "%{DATA:authority}" "%{DATA:upstream_host}"`,
+}
+
+var (
+	grokRef     = regexp.MustCompile(`%\{(\w+)(?::([\w.@-]+))?(?::(int|float|string))?\}`)
+	builtinName = regexp.MustCompile(`^[A-Z0-9_]+$`)
+	number      = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+	timeLayouts = []string{
+		"02/Jan/2006:15:04:05 -0700",
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.000Z0700",
+		"2006-01-02 15:04:05.000Z0700",
+		"2006-01-02 15:04:05",
+	}
+)
+
+type field struct {
+	name  string
+	typ   string
+	infer bool
+}
+
+// Pattern extracts fields from the lines matching a grok expression or a regular expression.
+type Pattern struct {
+	expr   string
+	re     *regexp.Regexp
+	fields map[string]field // by group name
+}
+
+// Compile compiles a built-in pattern name (i.e. "COMBINEDAPACHELOG"), a grok expression or a regular
+// expression with named groups. The fields of grok expressions are strings unless they have a type (int or
+// float), the named groups of regular expressions are converted to numbers when possible.
+func Compile(expr string) (*Pattern, error) {
+	if builtinName.MatchString(expr) {
+		if _, ok := Builtins[expr]; !ok {
+			return nil, fmt.Errorf("unknown pattern %q (built-in patterns: %s)", expr, strings.Join(Names(), ", "))
+		}
+		expr = "%{" + expr + "}"
+	}
+
+	p := &Pattern{
+		expr:   expr,
+		fields: map[string]field{},
+	}
+	source := expr
+	if grokRef.MatchString(expr) {
+		var err error
+		source, err = p.expand(expr, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	re, err := regexp.Compile("^(?:" + source + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("compiling pattern %q: %v", expr, err)
+	}
+	p.re = re
+
+	for _, name := range re.SubexpNames()[1:] {
+		if _, ok := p.fields[name]; name != "" && !ok {
+			p.fields[name] = field{name: name, infer: true}
+		}
+	}
+	if len(p.fields) == 0 {
+		return nil, fmt.Errorf("pattern %q does not extract any field", expr)
+	}
+
+	return p, nil
+}
+
+// expand replaces the grok references with the patterns, capturing the named references in numbered groups.
+func (p *Pattern) expand(expr string, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", fmt.Errorf("pattern %q is nested too deeply", p.expr)
+	}
+
+	var err error
+	expanded := grokRef.ReplaceAllStringFunc(expr, func(ref string) string {
+		m := grokRef.FindStringSubmatch(ref)
+		pattern, ok := Builtins[m[1]]
+		if !ok {
+			err = fmt.Errorf("unknown pattern %q in %q (built-in patterns: %s)", m[1], p.expr, strings.Join(Names(), ", "))
+			return ""
+		}
+		sub, subErr := p.expand(pattern, depth+1)
+		if subErr != nil {
+			err = subErr
+			return ""
+		}
+		if m[2] == "" {
+			return "(?:" + sub + ")"
+		}
+
+		group := fmt.Sprintf("grok%d", len(p.fields))
+		p.fields[group] = field{name: m[2], typ: m[3]}
+		return "(?P<" + group + ">" + sub + ")"
+	})
+
+	return expanded, err
+}
+
+func (p *Pattern) String() string {
+	return p.expr
+}
+
+// Parse returns the fields extracted from the line, if it matches. Fields that did not match, or are "-",
+// are left out.
+func (p *Pattern) Parse(line string) (map[string]interface{}, bool) {
+	m := p.re.FindStringSubmatchIndex(line)
+	if m == nil {
+		return nil, false
+	}
+
+	entry := map[string]interface{}{}
+	for i, name := range p.re.SubexpNames() {
+		f, ok := p.fields[name]
+		if !ok || m[2*i] < 0 {
+			continue
+		}
+		value := line[m[2*i]:m[2*i+1]]
+		if value == "-" || value == "" {
+			continue
+		}
+		if _, ok := entry[f.name]; ok {
+			continue
+		}
+		entry[f.name] = convert(value, f.typ, f.infer)
+	}
+
+	return entry, true
+}
+
+func convert(value, typ string, infer bool) interface{} {
+	if strings.HasPrefix(value, `"`) {
+		if s, err := strconv.Unquote(value); err == nil {
+			value = s
+		}
+	}
+
+	switch {
+	case typ == "int":
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	case typ == "float":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case infer && number.MatchString(value):
+		return json.Number(value)
+	}
+
+	return value
+}
+
+// Patterns tries its patterns in order on the lines that are not JSON objects.
+type Patterns []*Pattern
+
+func CompileAll(exprs []string) (Patterns, error) {
+	patterns := make(Patterns, 0, len(exprs))
+	for _, expr := range exprs {
+		p, err := Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// Parse converts the line to a JSON entry with the fields extracted by the first matching pattern. The time
+// field is converted to RFC 3339, the message defaults to the line, and the level is derived from the status
+// code if the pattern does not extract it. It returns false if the line is JSON or if no pattern matches.
+func (ps Patterns) Parse(line []byte) ([]byte, bool) {
+	if len(ps) == 0 || len(line) == 0 || line[0] == '{' {
+		return nil, false
+	}
+
+	s := string(line)
+	for _, p := range ps {
+		entry, ok := p.Parse(s)
+		if !ok {
+			continue
+		}
+
+		if t, ok := entry["time"].(string); ok {
+			entry["time"] = parseTime(t)
+		}
+		if _, ok := entry["msg"]; !ok {
+			entry["msg"] = s
+		}
+		if _, ok := entry["level"]; !ok {
+			entry["level"] = statusLevel(entry["status"])
+		}
+
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, false
+		}
+		return b, true
+	}
+
+	return nil, false
+}
+
+func parseTime(s string) string {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format(time.RFC3339Nano)
+		}
+	}
+
+	return s
+}
+
+func statusLevel(status interface{}) string {
+	var code int64
+	switch s := status.(type) {
+	case int64:
+		code = s
+	case json.Number:
+		code, _ = s.Int64()
+	}
+
+	switch {
+	case code >= 500:
+		return "error"
+	case code >= 400:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// Names returns the names of the built-in patterns.
+func Names() []string {
+	names := make([]string, 0, len(Builtins))
+	for name := range Builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,111 @@
+package grok
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileUnknownPattern(t *testing.T) {
+	for _, expr := range []string{"APACHE", "%{IP:client} %{STATUS:status}"} {
+		_, err := Compile(expr)
+		if err == nil {
+			t.Errorf("expected an error for %q", expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), "COMBINEDAPACHELOG, COMMONAPACHELOG") {
+			t.Errorf("error for %q does not list the built-in patterns: %v", expr, err)
+		}
+	}
+}
+
+func TestPatternsParse(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		line string
+		want string
+	}{
+		{
+			name: "common apache log",
+			expr: "COMMONAPACHELOG",
+			line: `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			want: `{"auth":"frank","bytes":2326,"client":"127.0.0.1","http_version":"1.0","level":"info","method":"GET","msg":"127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] \"GET /apache_pb.gif HTTP/1.0\" 200 2326","path":"/apache_pb.gif","status":200,"time":"2000-10-10T13:55:36-07:00"}`,
+		},
+		{
+			name: "combined apache log",
+			expr: "COMBINEDAPACHELOG",
+			line: `::1 - - [10/Oct/2000:13:55:36 +0000] "POST /login HTTP/1.1" 404 - "http://example.com/" "Mozilla/5.0 (X11)"`,
+			want: `{"client":"::1","http_version":"1.1","level":"warning","method":"POST","msg":"::1 - - [10/Oct/2000:13:55:36 +0000] \"POST /login HTTP/1.1\" 404 - \"http://example.com/\" \"Mozilla/5.0 (X11)\"","path":"/login","referrer":"http://example.com/","status":404,"time":"2000-10-10T13:55:36Z","user_agent":"Mozilla/5.0 (X11)"}`,
+		},
+		{
+			name: "nginx access log",
+			expr: "NGINXACCESS",
+			line: `10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /api HTTP/2.0" 502 157 "-" "curl/8.0" "203.0.113.9" 0.005`,
+			want: `{"bytes":157,"client":"10.0.0.1","duration":0.005,"forwarded_for":"203.0.113.9","http_version":"2.0","level":"error","method":"GET","msg":"10.0.0.1 - - [10/Oct/2000:13:55:36 +0000] \"GET /api HTTP/2.0\" 502 157 \"-\" \"curl/8.0\" \"203.0.113.9\" 0.005","path":"/api","status":502,"time":"2000-10-10T13:55:36Z","user_agent":"curl/8.0"}`,
+		},
+		{
+			name: "envoy access log",
+			expr: "ENVOYACCESS",
+			line: `[2024-01-01T12:00:00.000Z] "GET /users HTTP/1.1" 200 - 0 512 12 10 "10.0.0.1" "curl/8.0" "abc-123" "api.example.com" "10.0.1.5:8080"`,
+			want: `{"authority":"api.example.com","bytes":512,"bytes_received":0,"duration_ms":12,"forwarded_for":"10.0.0.1","level":"info","method":"GET","msg":"[2024-01-01T12:00:00.000Z] \"GET /users HTTP/1.1\" 200 - 0 512 12 10 \"10.0.0.1\" \"curl/8.0\" \"abc-123\" \"api.example.com\" \"10.0.1.5:8080\"","path":"/users","protocol":"HTTP/1.1","request_id":"abc-123","status":200,"time":"2024-01-01T12:00:00Z","upstream_host":"10.0.1.5:8080","upstream_service_time_ms":10,"user_agent":"curl/8.0"}`,
+		},
+		{
+			name: "typed fields",
+			expr: `%{NUMBER:count:int} %{NUMBER:ratio:float} %{NUMBER:version} %{NUMBER:bad:int}`,
+			line: "42 1.5 2 4.2",
+			want: `{"bad":"4.2","count":42,"level":"info","msg":"42 1.5 2 4.2","ratio":1.5,"version":"2"}`,
+		},
+		{
+			name: "quoted strings",
+			expr: `%{WORD:level} %{QS:msg}`,
+			line: `warn "disk \"full\""`,
+			want: `{"level":"warn","msg":"disk \"full\""}`,
+		},
+		{
+			name: "regexp with named groups",
+			expr: `(?P<level>\w+) code=(?P<code>\d+) id=(?P<id>\d+) (?P<msg>.*)`,
+			line: "warn code=12 id=007 retrying",
+			want: `{"code":12,"id":"007","level":"warn","msg":"retrying"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patterns, err := CompileAll([]string{test.expr})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, ok := patterns.Parse([]byte(test.line))
+			if !ok {
+				t.Fatalf("Parse(%s) did not match", test.line)
+			}
+			if got := string(b); got != test.want {
+				t.Errorf("Parse(%s) =\n%s\nwant\n%s", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPatternsParseNoMatch(t *testing.T) {
+	patterns, err := CompileAll([]string{"COMMONAPACHELOG", `(?P<level>\w+): (?P<msg>.*)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"", `{"msg":"json"}`, "no match here"} {
+		if b, ok := patterns.Parse([]byte(line)); ok {
+			t.Errorf("Parse(%s) = %s, want no match", line, b)
+		}
+	}
+	if b, ok := patterns.Parse([]byte("error: failed")); !ok || string(b) != `{"level":"error","msg":"failed"}` {
+		t.Errorf("Parse = %s, %t, want the second pattern to match", b, ok)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{`\w+`, `(?P<a>`, `%{WORD:a}(`} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("expected an error for %q", expr)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package logfmt parses lines in the logfmt (key=value) format.
+package logfmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	number = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+	errInvalidKey   = errors.New("invalid key")
+	errInvalidValue = errors.New("invalid quoted value")
+	errBareKey      = errors.New("key without value")
+	errNotLogfmt    = errors.New("not enough key=value pairs")
+)
+
+// Parse parses a logfmt line. Quoted values are strings, other values are converted to numbers or booleans when
+// possible, bare keys are true. The line must have at least minPairs key=value pairs. With strict, bare keys are
+// rejected, so that text containing a few key=value pairs is not taken for logfmt.
+func Parse(line string, minPairs int, strict bool) (map[string]interface{}, error) {
+	entry, _, err := parse(line, minPairs, strict)
+
+	return entry, err
+}
+
+// parse is like Parse, also returning the keys in the order they first appear.
+func parse(line string, minPairs int, strict bool) (map[string]interface{}, []string, error) {
+	entry := map[string]interface{}{}
+	keys := []string{}
+	pairs := 0
+
+	s := line
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			break
+		}
+
+		end := strings.IndexAny(s, " \t=")
+		if end < 0 {
+			end = len(s)
+		}
+		key := s[:end]
+		if key == "" || strings.ContainsAny(key, `"\`) {
+			return nil, nil, errInvalidKey
+		}
+		s = s[end:]
+		if _, ok := entry[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		if !strings.HasPrefix(s, "=") {
+			if strict {
+				return nil, nil, errBareKey
+			}
+			entry[key] = true
+			continue
+		}
+		s = s[1:]
+		pairs++
+
+		if strings.HasPrefix(s, `"`) {
+			end := closingQuote(s)
+			if end < 0 {
+				return nil, nil, errInvalidValue
+			}
+			value, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, nil, errInvalidValue
+			}
+			entry[key] = value
+			s = s[end+1:]
+			if s != "" && s[0] != ' ' && s[0] != '\t' {
+				return nil, nil, errInvalidValue
+			}
+			continue
+		}
+
+		end = strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		entry[key] = value(s[:end])
+		s = s[end:]
+	}
+
+	if pairs < minPairs || pairs == 0 {
+		return nil, nil, errNotLogfmt
+	}
+
+	return entry, keys, nil
+}
+
+// ToJSON converts a logfmt line to a JSON object, with the keys in the order of the line.
+func ToJSON(line []byte, minPairs int, strict bool) ([]byte, error) {
+	entry, keys, err := parse(string(line), minPairs, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(entry[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+
+	return b.Bytes(), nil
+}
+
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+
+	return -1
+}
+
+func value(s string) interface{} {
+	switch {
+	case s == "true":
+		return true
+	case s == "false":
+		return false
+	case number.MatchString(s):
+		return json.Number(s)
+	default:
+		return s
+	}
+}
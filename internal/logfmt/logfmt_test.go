@@ -0,0 +1,119 @@
+package logfmt
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line     string
+		minPairs int
+		strict   bool
+		want     map[string]interface{}
+		wantErr  bool
+	}{
+		{
+			line:     `level=info msg="user logged in" id=42 ratio=0.5 ok=true`,
+			minPairs: 1,
+			want: map[string]interface{}{
+				"level": "info",
+				"msg":   "user logged in",
+				"id":    json.Number("42"),
+				"ratio": json.Number("0.5"),
+				"ok":    true,
+			},
+		},
+		{
+			line:     `msg="quoted \"value\"" path=/a=b empty=`,
+			minPairs: 1,
+			want: map[string]interface{}{
+				"msg":   `quoted "value"`,
+				"path":  "/a=b",
+				"empty": "",
+			},
+		},
+		{
+			line:     "level=debug\tcached  version=01",
+			minPairs: 2,
+			want: map[string]interface{}{
+				"level":   "debug",
+				"cached":  true,
+				"version": "01",
+			},
+		},
+		{
+			line:     "level=debug cached version=1",
+			minPairs: 2,
+			strict:   true,
+			wantErr:  true,
+		},
+		{
+			line:     "user logged in id=3 ip=10.0.0.1",
+			minPairs: 2,
+			strict:   true,
+			wantErr:  true,
+		},
+		{
+			line:     "level=info msg=started",
+			minPairs: 2,
+			strict:   true,
+			want: map[string]interface{}{
+				"level": "info",
+				"msg":   "started",
+			},
+		},
+		{
+			line:     "retrying with timeout=3s",
+			minPairs: 2,
+			wantErr:  true,
+		},
+		{
+			line:     "plain text",
+			minPairs: 0,
+			wantErr:  true,
+		},
+		{
+			line:     `msg="unterminated`,
+			minPairs: 1,
+			wantErr:  true,
+		},
+		{
+			line:     `msg="value"trailing`,
+			minPairs: 1,
+			wantErr:  true,
+		},
+		{
+			line:     `a"b=c`,
+			minPairs: 1,
+			wantErr:  true,
+		},
+		{
+			line:     "",
+			minPairs: 1,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.line, test.minPairs, test.strict)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Parse(%q, %d, %t) error = %v, want error: %t", test.line, test.minPairs, test.strict, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q, %d, %t) = %v, want %v", test.line, test.minPairs, test.strict, got, test.want)
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	b, err := ToJSON([]byte(`msg="a b" n=1 ok=false level=info n=2`), 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"msg":"a b","n":2,"ok":false,"level":"info"}`; got != want {
+		t.Errorf("ToJSON = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+// Package multiline joins the lines of multi-line events, such as stack traces printed as plain text, folding
+// the continuation lines into the stacktrace field of the line that started the event.
+package multiline
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxLines is the maximum number of lines in an event, longer events are split.
+var MaxLines = 1000
+
+// Detector reports whether a line continues an event, given the lines already in the event.
+type Detector func(line string, event []string) bool
+
+var (
+	javaFrame     = regexp.MustCompile(`^\s+at\s|^\s*\.\.\. \d+ (more|common frames omitted)$|^\s*Caused by: |^\s+Suppressed: `)
+	javaException = regexp.MustCompile(`^([a-zA-Z_$][\w$]*\.)+[\w$]*(Exception|Error|Throwable)(: |$)`)
+
+	pythonTraceback = "Traceback (most recent call last):"
+	pythonChained   = regexp.MustCompile(`^(During handling of the above exception, another exception occurred|The above exception was the direct cause of the following exception):$`)
+	pythonException = regexp.MustCompile(`^[\w.]+(: |$)`)
+
+	goPanic     = regexp.MustCompile(`^(panic|fatal error): `)
+	goTraceLine = regexp.MustCompile(`^$|^\t|^goroutine \d+.*\[.*\]:$|^created by |^\[signal |^exit status \d+$|^[\w.*/()\[\]{}-]+\(.*\)$`)
+)
+
+// Detectors are the built-in detectors, by name.
+var Detectors = map[string]Detector{
+	"java":   java,
+	"python": python,
+	"go":     goroutines,
+}
+
+// java continues events with stack frames, "Caused by:" lines and the exception line following a log line.
+func java(line string, event []string) bool {
+	return javaFrame.MatchString(line) || javaException.MatchString(line)
+}
+
+// python continues events with tracebacks, up to the exception line, including chained exceptions.
+func python(line string, event []string) bool {
+	if line == pythonTraceback {
+		return true
+	}
+
+	inTraceback := false
+	for _, l := range event {
+		if l == pythonTraceback {
+			inTraceback = true
+			break
+		}
+	}
+	if !inTraceback {
+		return false
+	}
+
+	last := event[len(event)-1]
+	switch {
+	case line == "" || pythonChained.MatchString(line):
+		return true
+	case strings.HasPrefix(line, " "):
+		return true
+	default:
+		return strings.HasPrefix(last, " ") && pythonException.MatchString(line)
+	}
+}
+
+// goroutines continues the events started by a panic with the goroutine traces.
+func goroutines(line string, event []string) bool {
+	return goPanic.MatchString(event[0]) && goTraceLine.MatchString(line)
+}
+
+// ParseDetectors returns the built-in detectors with these names.
+func ParseDetectors(names []string) ([]Detector, error) {
+	detectors := make([]Detector, 0, len(names))
+	for _, name := range names {
+		d, ok := Detectors[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown multi-line detector %q (expected one of %s)", name, strings.Join(detectorNames(), ", "))
+		}
+		detectors = append(detectors, d)
+	}
+
+	return detectors, nil
+}
+
+func detectorNames() []string {
+	ss := make([]string, 0, len(Detectors))
+	for name := range Detectors {
+		ss = append(ss, name)
+	}
+	sort.Strings(ss)
+
+	return ss
+}
+
+// Event is a line, along with the continuation lines that followed it.
+type Event struct {
+	Line       []byte
+	Stacktrace string
+}
+
+// Config configures how lines are joined. Without start regexp or detectors, lines are not joined.
+type Config struct {
+	Start     *regexp.Regexp
+	Detectors []Detector
+	Timeout   time.Duration
+}
+
+// Joiner joins the lines added to it into events. A line continues the current event if a detector says so,
+// or if it does not match the start regexp when there is one; JSON lines always start an event. Events are
+// emitted when the next event starts, or when no line was added for the flush timeout.
+type Joiner struct {
+	start     *regexp.Regexp
+	detectors []Detector
+	timeout   time.Duration
+	emit      func(Event)
+
+	event []string
+	timer *time.Timer
+	m     *sync.Mutex
+}
+
+// NewJoiner returns a Joiner calling emit for each event.
+func NewJoiner(conf Config, emit func(Event)) *Joiner {
+	return &Joiner{
+		start:     conf.Start,
+		detectors: conf.Detectors,
+		timeout:   conf.Timeout,
+		emit:      emit,
+		m:         &sync.Mutex{},
+	}
+}
+
+// Add adds a line, with its line terminator removed.
+func (j *Joiner) Add(line string) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	line = strings.TrimRight(line, " \t\r\n")
+	if len(j.event) > 0 && len(j.event) < MaxLines && j.continues(line) {
+		j.event = append(j.event, line)
+		j.resetTimer()
+		return
+	}
+
+	j.flush()
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if j.start == nil && len(j.detectors) == 0 {
+		j.emit(Event{Line: []byte(strings.TrimSpace(line))})
+		return
+	}
+	j.event = append(j.event, line)
+	j.resetTimer()
+}
+
+func (j *Joiner) continues(line string) bool {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return false
+	}
+	for _, d := range j.detectors {
+		if d(line, j.event) {
+			return true
+		}
+	}
+
+	return j.start != nil && !j.start.MatchString(line)
+}
+
+func (j *Joiner) resetTimer() {
+	if j.timeout <= 0 {
+		return
+	}
+	if j.timer == nil {
+		j.timer = time.AfterFunc(j.timeout, j.Flush)
+		return
+	}
+	j.timer.Reset(j.timeout)
+}
+
+// Flush emits the current event, if any.
+func (j *Joiner) Flush() {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	j.flush()
+}
+
+func (j *Joiner) flush() {
+	if len(j.event) == 0 {
+		return
+	}
+
+	event := Event{
+		Line:       []byte(strings.TrimSpace(j.event[0])),
+		Stacktrace: strings.Trim(strings.Join(j.event[1:], "\n"), "\n"),
+	}
+	j.event = j.event[:0]
+	j.emit(event)
+}
+
+// Close emits the current event and stops the flush timer.
+func (j *Joiner) Close() {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	j.flush()
+}
+
+// Fold adds the stacktrace to a JSON line, after its own stack trace if it has one. Other lines are
+// converted to JSON, with the line as the message.
+func Fold(line []byte, stacktrace string) []byte {
+	if stacktrace == "" {
+		return line
+	}
+
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(line, &entry); err != nil || entry == nil {
+		entry = map[string]json.RawMessage{}
+		entry["msg"], _ = json.Marshal(string(line))
+	}
+
+	var previous string
+	if err := json.Unmarshal(entry["stacktrace"], &previous); err == nil && previous != "" {
+		stacktrace = previous + "\n" + stacktrace
+	}
+	entry["stacktrace"], _ = json.Marshal(stacktrace)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return line
+	}
+
+	return b
+}
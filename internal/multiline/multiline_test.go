@@ -0,0 +1,216 @@
+package multiline
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectors(t *testing.T) {
+	tests := []struct {
+		detector string
+		event    []string
+		line     string
+		want     bool
+	}{
+		{"java", []string{"ERROR request failed"}, "java.lang.IllegalStateException: closed", true},
+		{"java", []string{"ERROR request failed"}, "\tat com.example.Server.handle(Server.java:42)", true},
+		{"java", []string{"ERROR request failed", "\tat a.B.c(B.java:1)"}, "Caused by: java.io.IOException: reset", true},
+		{"java", []string{"ERROR request failed", "\tat a.B.c(B.java:1)"}, "\t... 12 more", true},
+		{"java", []string{"ERROR request failed"}, "INFO request served", false},
+		{"java", []string{"ERROR request failed"}, "Exception: not qualified", false},
+
+		{"python", []string{"ERROR request failed"}, "Traceback (most recent call last):", true},
+		{"python", []string{"ERROR request failed", "Traceback (most recent call last):"}, `  File "app.py", line 3, in <module>`, true},
+		{"python", []string{"ERROR", "Traceback (most recent call last):", `  File "app.py", line 3, in <module>`}, "ValueError: invalid literal", true},
+		{"python", []string{"ERROR", "Traceback (most recent call last):", "  raise", "ValueError: x"}, "", true},
+		{"python", []string{"ERROR", "Traceback (most recent call last):", "  raise", "ValueError: x", ""}, "During handling of the above exception, another exception occurred:", true},
+		{"python", []string{"ERROR", "Traceback (most recent call last):", "  raise", "ValueError: x"}, "INFO: next request", false},
+		{"python", []string{"ERROR request failed"}, "  indented", false},
+
+		{"go", []string{"panic: runtime error: index out of range"}, "", true},
+		{"go", []string{"panic: runtime error: index out of range", ""}, "goroutine 1 [running]:", true},
+		{"go", []string{"panic: x", "goroutine 1 [running]:"}, "main.main()", true},
+		{"go", []string{"panic: x", "goroutine 1 [running]:", "main.main()"}, "\t/app/main.go:12 +0x1d", true},
+		{"go", []string{"panic: x"}, "exit status 2", true},
+		{"go", []string{"level=info msg=started"}, "\tindented", false},
+		{"go", []string{"panic: x", "goroutine 1 [running]:"}, "level=info msg=restarted", false},
+	}
+
+	for _, test := range tests {
+		if got := Detectors[test.detector](test.line, test.event); got != test.want {
+			t.Errorf("%s(%q, %q) = %t, want %t", test.detector, test.line, test.event, got, test.want)
+		}
+	}
+}
+
+func TestParseDetectors(t *testing.T) {
+	detectors, err := ParseDetectors([]string{"Java", " go "})
+	if err != nil || len(detectors) != 2 {
+		t.Errorf("ParseDetectors = %d detectors, %v", len(detectors), err)
+	}
+
+	_, err = ParseDetectors([]string{"ruby"})
+	if err == nil || !strings.Contains(err.Error(), "go, java, python") {
+		t.Errorf("error = %v, want the detector names", err)
+	}
+}
+
+func joinAll(conf Config, lines []string) []Event {
+	events := []Event{}
+	j := NewJoiner(conf, func(event Event) {
+		events = append(events, event)
+	})
+	for _, line := range lines {
+		j.Add(line + "\n")
+	}
+	j.Close()
+
+	return events
+}
+
+func TestJoiner(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  Config
+		lines []string
+		want  []Event
+	}{
+		{
+			name:  "not joined",
+			lines: []string{"a", "  b", "", "c"},
+			want:  []Event{{Line: []byte("a")}, {Line: []byte("b")}, {Line: []byte("c")}},
+		},
+		{
+			name: "java",
+			conf: Config{Detectors: []Detector{java}},
+			lines: []string{
+				"ERROR request failed",
+				"java.lang.IllegalStateException: closed",
+				"\tat com.example.Server.handle(Server.java:42)",
+				`{"msg":"next"}`,
+				"INFO done",
+			},
+			want: []Event{
+				{Line: []byte("ERROR request failed"), Stacktrace: "java.lang.IllegalStateException: closed\n\tat com.example.Server.handle(Server.java:42)"},
+				{Line: []byte(`{"msg":"next"}`)},
+				{Line: []byte("INFO done")},
+			},
+		},
+		{
+			name: "python",
+			conf: Config{Detectors: []Detector{python}},
+			lines: []string{
+				"ERROR request failed",
+				"Traceback (most recent call last):",
+				`  File "app.py", line 3, in <module>`,
+				"ValueError: invalid literal",
+				"INFO next request",
+			},
+			want: []Event{
+				{Line: []byte("ERROR request failed"), Stacktrace: "Traceback (most recent call last):\n  File \"app.py\", line 3, in <module>\nValueError: invalid literal"},
+				{Line: []byte("INFO next request")},
+			},
+		},
+		{
+			name: "go",
+			conf: Config{Detectors: []Detector{goroutines}},
+			lines: []string{
+				"panic: boom",
+				"",
+				"goroutine 1 [running]:",
+				"main.main()",
+				"\t/app/main.go:12 +0x1d",
+				"exit status 2",
+				"starting",
+			},
+			want: []Event{
+				{Line: []byte("panic: boom"), Stacktrace: "goroutine 1 [running]:\nmain.main()\n\t/app/main.go:12 +0x1d\nexit status 2"},
+				{Line: []byte("starting")},
+			},
+		},
+		{
+			name:  "start regexp",
+			conf:  Config{Start: regexp.MustCompile(`^\d{4}-`)},
+			lines: []string{"2024-01-01 a", "continued", "2024-01-02 b"},
+			want: []Event{
+				{Line: []byte("2024-01-01 a"), Stacktrace: "continued"},
+				{Line: []byte("2024-01-02 b")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := joinAll(test.conf, test.lines); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("events = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJoinerMaxLines(t *testing.T) {
+	defer func(max int) { MaxLines = max }(MaxLines)
+	MaxLines = 3
+
+	events := joinAll(Config{Detectors: []Detector{java}}, []string{"ERROR", "\tat a", "\tat b", "\tat c"})
+	want := []Event{
+		{Line: []byte("ERROR"), Stacktrace: "\tat a\n\tat b"},
+		{Line: []byte("at c")},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestJoinerTimeout(t *testing.T) {
+	events := make(chan Event, 2)
+	j := NewJoiner(Config{Detectors: []Detector{goroutines}, Timeout: 20 * time.Millisecond}, func(event Event) {
+		events <- event
+	})
+	defer j.Close()
+
+	j.Add("panic: boom\n")
+	j.Add("goroutine 1 [running]:\n")
+
+	select {
+	case event := <-events:
+		want := Event{Line: []byte("panic: boom"), Stacktrace: "goroutine 1 [running]:"}
+		if !reflect.DeepEqual(event, want) {
+			t.Errorf("event = %q, want %q", event, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event to be flushed")
+	}
+
+	j.Add("main.main()\n")
+	select {
+	case event := <-events:
+		if string(event.Line) != "main.main()" {
+			t.Errorf("event after the flush = %q, want a new event", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the second event to be flushed")
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		line       string
+		stacktrace string
+		want       string
+	}{
+		{`{"msg":"a"}`, "", `{"msg":"a"}`},
+		{`{"msg":"a"}`, "\tat b", `{"msg":"a","stacktrace":"\tat b"}`},
+		{`{"msg":"a","stacktrace":"own"}`, "\tat b", `{"msg":"a","stacktrace":"own\n\tat b"}`},
+		{"plain text", "\tat b", `{"msg":"plain text","stacktrace":"\tat b"}`},
+	}
+
+	for _, test := range tests {
+		if got := string(Fold([]byte(test.line), test.stacktrace)); got != test.want {
+			t.Errorf("Fold(%s, %q) = %s, want %s", test.line, test.stacktrace, got, test.want)
+		}
+	}
+}
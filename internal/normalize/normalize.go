@@ -0,0 +1,454 @@
+// Package normalize rewrites the lines of common structured logging formats to the keys used by logrus
+// (time, level and msg), so that they can be handled like logrus lines.
+package normalize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Pimmr/logs-dashboard/internal/logfmt"
+	"github.com/tidwall/gjson"
+)
+
+type Format string
+
+const (
+	Auto    Format = "auto"
+	None    Format = "none"
+	Logrus  Format = "logrus"
+	Zap     Format = "zap"
+	Zerolog Format = "zerolog"
+	Bunyan  Format = "bunyan"
+	ECS     Format = "ecs"
+	GCP     Format = "gcp"
+	Logfmt  Format = "logfmt"
+)
+
+var Formats = []Format{Auto, None, Logrus, Zap, Zerolog, Bunyan, ECS, GCP, Logfmt}
+
+// AutoLogfmtPairs is the number of key=value pairs a line needs to be detected as logfmt, so that plain text
+// containing an '=' is left alone. Lines with words that are not key=value pairs are never detected as logfmt.
+var AutoLogfmtPairs = 2
+
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == strings.ToLower(s) {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown log format %q (expected one of %s)", s, joinFormats(Formats))
+}
+
+func joinFormats(ff []Format) string {
+	ss := make([]string, len(ff))
+	for i, f := range ff {
+		ss[i] = string(f)
+	}
+
+	return strings.Join(ss, ", ")
+}
+
+var severityLevels = map[string]string{
+	"":          "info",
+	"DEFAULT":   "info",
+	"DEBUG":     "debug",
+	"INFO":      "info",
+	"NOTICE":    "info",
+	"WARNING":   "warning",
+	"ERROR":     "error",
+	"CRITICAL":  "fatal",
+	"ALERT":     "fatal",
+	"EMERGENCY": "panic",
+}
+
+// SeverityLevel maps a Cloud Logging severity to a logrus level.
+func SeverityLevel(severity string) (string, bool) {
+	level, ok := severityLevels[strings.ToUpper(severity)]
+
+	return level, ok
+}
+
+var bunyanLevels = []struct {
+	min   float64
+	level string
+}{
+	{60, "fatal"},
+	{50, "error"},
+	{40, "warning"},
+	{30, "info"},
+	{20, "debug"},
+	{0, "trace"},
+}
+
+// Normalizer rewrites lines to the logrus keys. In Auto mode the format of each line is detected, lines that
+// could be in several formats use the format last detected, so a Normalizer should be used for each source.
+// The values of the logrus keys that are rewritten are kept, prefixed with the format (i.e. "bunyan.level"), and
+// the keys of the rewritten lines keep their order, the keys added coming last.
+// A Normalizer is not safe for concurrent use.
+type Normalizer struct {
+	format   Format
+	detected Format
+}
+
+func New(format Format) *Normalizer {
+	return &Normalizer{
+		format: format,
+	}
+}
+
+// Normalize returns the line with the logrus keys. Logfmt lines are converted to JSON (in Auto mode, only if
+// they have at least AutoLogfmtPairs pairs and nothing else), then their keys are normalized like JSON lines.
+// Other lines, or lines already in the logrus format, are returned unchanged.
+func (n *Normalizer) Normalize(line []byte) []byte {
+	if n.format == None || n.format == Logrus {
+		return line
+	}
+
+	converted := false
+	if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) {
+		if n.format != Auto && n.format != Logfmt {
+			return line
+		}
+		minPairs := AutoLogfmtPairs
+		if n.format == Logfmt {
+			minPairs = 1
+		}
+		b, err := logfmt.ToJSON(bytes.TrimSpace(line), minPairs, n.format == Auto)
+		if err != nil {
+			return line
+		}
+		line = b
+		converted = true
+	}
+
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(line, &entry); err != nil || entry == nil {
+		return line
+	}
+
+	format := n.format
+	if format == Auto || format == Logfmt {
+		format = Detect(entry)
+		if format == "" {
+			format = n.detected
+		}
+		if format != "" {
+			n.detected = format
+		}
+	}
+
+	if !normalizers[format](entry, format) && !converted {
+		return line
+	}
+
+	return marshal(line, entry)
+}
+
+// marshal writes the entry with the keys of the original line first, in their original order, then the keys added
+// in lexical order.
+func marshal(original []byte, entry map[string]json.RawMessage) []byte {
+	b := &bytes.Buffer{}
+	b.WriteByte('{')
+	write := func(key []byte, value json.RawMessage) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+
+	written := make(map[string]bool, len(entry))
+	gjson.ParseBytes(original).ForEach(func(key, _ gjson.Result) bool {
+		value, ok := entry[key.Str]
+		if ok && !written[key.Str] {
+			written[key.Str] = true
+			write([]byte(key.Raw), value)
+		}
+		return true
+	})
+
+	added := make([]string, 0, len(entry)-len(written))
+	for key := range entry {
+		if !written[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		k, err := json.Marshal(key)
+		if err != nil {
+			continue
+		}
+		write(k, entry[key])
+	}
+	b.WriteByte('}')
+
+	return b.Bytes()
+}
+
+// Detect returns the format of an entry, or an empty format if it cannot be told apart.
+func Detect(entry map[string]json.RawMessage) Format {
+	_, hasTime := entry["time"]
+	_, hasMsg := entry["msg"]
+	_, hasMessage := entry["message"]
+	_, hasTs := entry["ts"]
+	level, hasLevel := entry["level"]
+	log, hasLog := entry["log"]
+
+	switch {
+	case has(entry, "@timestamp") || has(entry, "log.level") || has(entry, "ecs.version") ||
+		(hasLog && !hasLevel && bytes.HasPrefix(log, []byte("{"))):
+		return ECS
+	case has(entry, "severity") && !hasLevel:
+		return GCP
+	case hasLevel && isNumber(level) && has(entry, "v") && has(entry, "hostname"):
+		return Bunyan
+	case hasTs && hasLevel && hasMsg:
+		return Zap
+	case hasLevel && hasMessage && !hasMsg:
+		return Zerolog
+	case hasTime && hasLevel && hasMsg:
+		return Logrus
+	default:
+		return ""
+	}
+}
+
+var normalizers = map[Format]func(map[string]json.RawMessage, Format) bool{
+	"":      func(map[string]json.RawMessage, Format) bool { return false },
+	Logrus:  func(map[string]json.RawMessage, Format) bool { return false },
+	Zap:     normalizeZap,
+	Zerolog: normalizeZerolog,
+	Bunyan:  normalizeBunyan,
+	ECS:     normalizeECS,
+	GCP:     normalizeGCP,
+}
+
+func normalizeZap(entry map[string]json.RawMessage, format Format) bool {
+	changed := rename(entry, format, "ts", "time", parseTime)
+	changed = rewrite(entry, format, "level", levelName) || changed
+
+	return changed
+}
+
+func normalizeZerolog(entry map[string]json.RawMessage, format Format) bool {
+	changed := rename(entry, format, "message", "msg", nil)
+	changed = rewrite(entry, format, "time", parseTime) || changed
+	changed = rewrite(entry, format, "level", levelName) || changed
+
+	return changed
+}
+
+func normalizeBunyan(entry map[string]json.RawMessage, format Format) bool {
+	return rewrite(entry, format, "level", func(v interface{}) (interface{}, bool) {
+		f, ok := v.(float64)
+		if !ok {
+			return levelName(v)
+		}
+		for _, l := range bunyanLevels {
+			if f >= l.min {
+				return l.level, true
+			}
+		}
+		return nil, false
+	})
+}
+
+func normalizeECS(entry map[string]json.RawMessage, format Format) bool {
+	changed := rename(entry, format, "@timestamp", "time", parseTime)
+	changed = rename(entry, format, "message", "msg", nil) || changed
+
+	if _, ok := entry["log.level"]; ok {
+		changed = rename(entry, format, "log.level", "level", levelName) || changed
+	} else if level, ok := nested(entry, "log", "level"); ok {
+		changed = set(entry, format, "level", level, levelName) || changed
+	}
+
+	if _, ok := entry["error.stack_trace"]; ok {
+		changed = rename(entry, format, "error.stack_trace", "stacktrace", nil) || changed
+	} else if stack, ok := nested(entry, "error", "stack_trace"); ok {
+		changed = set(entry, format, "stacktrace", stack, nil) || changed
+	}
+
+	return changed
+}
+
+func normalizeGCP(entry map[string]json.RawMessage, format Format) bool {
+	changed := rename(entry, format, "message", "msg", nil)
+	changed = rename(entry, format, "severity", "level", func(v interface{}) (interface{}, bool) {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		level, ok := SeverityLevel(s)
+		return level, ok
+	}) || changed
+
+	if _, ok := entry["timestamp"]; ok {
+		changed = rename(entry, format, "timestamp", "time", parseTime) || changed
+	} else {
+		seconds, hasSeconds := entry["timestampSeconds"]
+		nanos, hasNanos := entry["timestampNanos"]
+		if hasSeconds {
+			t := map[string]json.RawMessage{"seconds": seconds}
+			if hasNanos {
+				t["nanos"] = nanos
+			}
+			b, _ := json.Marshal(t)
+			changed = set(entry, format, "time", b, parseTime) || changed
+		}
+	}
+
+	return changed
+}
+
+// rename copies the value of key to the canonical key, converted with conv if not nil. The canonical key is
+// only overwritten if the conversion succeeds, its original value is kept.
+func rename(entry map[string]json.RawMessage, format Format, key, canonical string, conv func(interface{}) (interface{}, bool)) bool {
+	raw, ok := entry[key]
+	if !ok {
+		return false
+	}
+
+	return set(entry, format, canonical, raw, conv)
+}
+
+// rewrite converts the value of a canonical key in place, keeping the original value.
+func rewrite(entry map[string]json.RawMessage, format Format, canonical string, conv func(interface{}) (interface{}, bool)) bool {
+	raw, ok := entry[canonical]
+	if !ok {
+		return false
+	}
+
+	return set(entry, format, canonical, raw, conv)
+}
+
+func set(entry map[string]json.RawMessage, format Format, canonical string, raw json.RawMessage, conv func(interface{}) (interface{}, bool)) bool {
+	value := raw
+	if conv != nil {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return false
+		}
+		converted, ok := conv(v)
+		if !ok {
+			return false
+		}
+		b, err := json.Marshal(converted)
+		if err != nil {
+			return false
+		}
+		value = b
+	}
+
+	if original, ok := entry[canonical]; ok {
+		if bytes.Equal(original, value) {
+			return false
+		}
+		entry[string(format)+"."+canonical] = original
+	}
+	entry[canonical] = value
+
+	return true
+}
+
+func nested(entry map[string]json.RawMessage, key, sub string) (json.RawMessage, bool) {
+	raw, ok := entry[key]
+	if !ok {
+		return nil, false
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, false
+	}
+	v, ok := m[sub]
+
+	return v, ok
+}
+
+func has(entry map[string]json.RawMessage, key string) bool {
+	_, ok := entry[key]
+
+	return ok
+}
+
+func isNumber(raw json.RawMessage) bool {
+	var f float64
+
+	return json.Unmarshal(raw, &f) == nil
+}
+
+// levelName converts a level to the logrus level name.
+func levelName(v interface{}) (interface{}, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+
+	switch level := strings.ToLower(s); level {
+	case "warn":
+		return "warning", true
+	case "dpanic", "err":
+		return "error", true
+	case "crit", "critical", "alert", "emerg", "emergency":
+		return "fatal", true
+	case "notice":
+		return "info", true
+	default:
+		return level, true
+	}
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000Z0700", // zap's ISO8601 encoder
+	"2006-01-02 15:04:05.000Z0700",
+	"2006-01-02T15:04:05Z0700",
+}
+
+// parseTime converts a time to RFC 3339. Numbers are Unix timestamps in seconds, milliseconds, microseconds or
+// nanoseconds, depending on their magnitude.
+func parseTime(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.Format(time.RFC3339Nano), true
+			}
+		}
+		return nil, false
+	case float64:
+		return unixTime(v).Format(time.RFC3339Nano), true
+	case map[string]interface{}:
+		seconds, ok := v["seconds"].(float64)
+		if !ok {
+			return nil, false
+		}
+		nanos, _ := v["nanos"].(float64)
+		return time.Unix(int64(seconds), int64(nanos)).UTC().Format(time.RFC3339Nano), true
+	default:
+		return nil, false
+	}
+}
+
+func unixTime(f float64) time.Time {
+	switch abs := math.Abs(f); {
+	case abs < 1e11:
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e6))*1e3).UTC() // floats are not precise past microseconds
+	case abs < 1e14:
+		return time.Unix(0, int64(f*1e6)).UTC()
+	case abs < 1e17:
+		return time.Unix(0, int64(f*1e3)).UTC()
+	default:
+		return time.Unix(0, int64(f)).UTC()
+	}
+}
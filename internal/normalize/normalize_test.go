@@ -0,0 +1,144 @@
+package normalize
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		line   string
+		want   string
+	}{
+		{
+			name:   "none",
+			format: None,
+			line:   `{"ts":1600000000,"level":"warn","msg":"a"}`,
+			want:   `{"ts":1600000000,"level":"warn","msg":"a"}`,
+		},
+		{
+			name:   "logrus unchanged",
+			format: Auto,
+			line:   `{"msg":"a","time":"2020-09-13T12:26:40Z","level":"info"}`,
+			want:   `{"msg":"a","time":"2020-09-13T12:26:40Z","level":"info"}`,
+		},
+		{
+			name:   "unknown JSON unchanged",
+			format: Auto,
+			line:   `{"b":1,"a":2}`,
+			want:   `{"b":1,"a":2}`,
+		},
+		{
+			name:   "zap",
+			format: Auto,
+			line:   `{"ts":1600000000.5,"level":"warn","msg":"a"}`,
+			want:   `{"ts":1600000000.5,"level":"warning","msg":"a","time":"2020-09-13T12:26:40.5Z","zap.level":"warn"}`,
+		},
+		{
+			name:   "zerolog",
+			format: Auto,
+			line:   `{"level":"error","time":1600000000000,"message":"a"}`,
+			want:   `{"level":"error","time":"2020-09-13T12:26:40Z","message":"a","msg":"a","zerolog.time":1600000000000}`,
+		},
+		{
+			name:   "bunyan",
+			format: Auto,
+			line:   `{"v":0,"hostname":"h","level":50,"msg":"a","time":"2020-09-13T12:26:40Z"}`,
+			want:   `{"v":0,"hostname":"h","level":"error","msg":"a","time":"2020-09-13T12:26:40Z","bunyan.level":50}`,
+		},
+		{
+			name:   "ecs",
+			format: Auto,
+			line:   `{"@timestamp":"2020-09-13T12:26:40Z","log.level":"WARN","message":"a"}`,
+			want:   `{"@timestamp":"2020-09-13T12:26:40Z","log.level":"WARN","message":"a","level":"warning","msg":"a","time":"2020-09-13T12:26:40Z"}`,
+		},
+		{
+			name:   "gcp",
+			format: Auto,
+			line:   `{"severity":"CRITICAL","message":"a","timestampSeconds":1600000000,"timestampNanos":500}`,
+			want:   `{"severity":"CRITICAL","message":"a","timestampSeconds":1600000000,"timestampNanos":500,"level":"fatal","msg":"a","time":"2020-09-13T12:26:40.0000005Z"}`,
+		},
+		{
+			name:   "key order and values kept",
+			format: Auto,
+			line:   `{"z":{"b": 1, "a": "<2>"}, "level":"warn", "ts":1600000000, "msg":"a & b"}`,
+			want:   `{"z":{"b": 1, "a": "<2>"},"level":"warning","ts":1600000000,"msg":"a & b","time":"2020-09-13T12:26:40Z","zap.level":"warn"}`,
+		},
+		{
+			name:   "forced format",
+			format: Zap,
+			line:   `{"level":"warn","msg":"a"}`,
+			want:   `{"level":"warning","msg":"a","zap.level":"warn"}`,
+		},
+		{
+			name:   "logfmt",
+			format: Auto,
+			line:   `time=2020-09-13T12:26:40Z level=warn msg="a b"`,
+			want:   `{"time":"2020-09-13T12:26:40Z","level":"warn","msg":"a b"}`,
+		},
+		{
+			name:   "text with key=value pairs",
+			format: Auto,
+			line:   "user logged in id=3 ip=10.0.0.1",
+			want:   "user logged in id=3 ip=10.0.0.1",
+		},
+		{
+			name:   "text with a single pair",
+			format: Auto,
+			line:   "retrying timeout=3s",
+			want:   "retrying timeout=3s",
+		},
+		{
+			name:   "forced logfmt",
+			format: Logfmt,
+			line:   "retrying timeout=3s",
+			want:   `{"retrying":true,"timeout":"3s"}`,
+		},
+		{
+			name:   "plain text",
+			format: Auto,
+			line:   "starting server",
+			want:   "starting server",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(New(test.format).Normalize([]byte(test.line))); got != test.want {
+				t.Errorf("Normalize(%s) = %s, want %s", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDetectedFormat(t *testing.T) {
+	n := New(Auto)
+
+	// the format of lines that cannot be told apart is the format last detected
+	lines := []struct {
+		line string
+		want string
+	}{
+		{`{"level":"warn","msg":"a"}`, `{"level":"warn","msg":"a"}`},
+		{`{"ts":1600000000,"level":"info","msg":"a"}`, `{"ts":1600000000,"level":"info","msg":"a","time":"2020-09-13T12:26:40Z"}`},
+		{`{"level":"warn","msg":"a"}`, `{"level":"warning","msg":"a","zap.level":"warn"}`},
+	}
+	for _, l := range lines {
+		if got := string(n.Normalize([]byte(l.line))); got != l.want {
+			t.Errorf("Normalize(%s) = %s, want %s", l.line, got, l.want)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("ZAP")
+	if err != nil || format != Zap {
+		t.Errorf("ParseFormat(ZAP) = %q, %v", format, err)
+	}
+
+	_, err = ParseFormat("xml")
+	if err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,308 @@
+// Package redact removes secrets and personal data from log lines: the values of fields with matching names,
+// and the parts of values matching regexps or built-in detectors (JWTs, emails and credit card numbers).
+package redact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	mask       = "[redacted]"
+	hashPrefix = "[redacted:"
+	hashSuffix = "]"
+	hashLength = 12
+)
+
+// Detector finds values to redact. Matches of re are only redacted if valid accepts them, when set.
+type Detector struct {
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// Detectors are the built-in detectors, by name.
+var Detectors = map[string]Detector{
+	"jwt":   {re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)},
+	"email": {re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+	"card":  {re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: card},
+}
+
+var errHashKey = errors.New("hashing the redacted values needs a key, so that the hashes cannot be reversed by hashing guesses")
+
+// cardNetworks are the issuer identification number ranges of the main card networks, with the lengths of
+// their numbers.
+var cardNetworks = []struct {
+	prefixLength int
+	first, last  int
+	lengths      []int
+}{
+	{1, 4, 4, []int{13, 16, 19}},                 // Visa
+	{2, 51, 55, []int{16}},                       // Mastercard
+	{4, 2221, 2720, []int{16}},                   // Mastercard
+	{2, 34, 34, []int{15}},                       // American Express
+	{2, 37, 37, []int{15}},                       // American Express
+	{4, 6011, 6011, []int{16, 17, 18, 19}},       // Discover
+	{3, 644, 649, []int{16, 17, 18, 19}},         // Discover
+	{2, 65, 65, []int{16, 17, 18, 19}},           // Discover
+	{2, 62, 62, []int{16, 17, 18, 19}},           // UnionPay
+	{4, 3528, 3589, []int{16, 17, 18, 19}},       // JCB
+	{3, 300, 305, []int{14, 15, 16, 17, 18, 19}}, // Diners Club
+	{2, 36, 36, []int{14, 15, 16, 17, 18, 19}},   // Diners Club
+	{2, 38, 39, []int{16, 17, 18, 19}},           // Diners Club
+}
+
+// card reports whether s is a card number: its digits must start with the prefix of a card network, have one of
+// the lengths of its numbers, and pass the Luhn checksum.
+func card(s string) bool {
+	digits := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			digits = append(digits, s[i])
+		}
+	}
+
+	for _, network := range cardNetworks {
+		prefix := 0
+		for _, c := range digits[:network.prefixLength] {
+			prefix = prefix*10 + int(c-'0')
+		}
+		if prefix < network.first || prefix > network.last {
+			continue
+		}
+		for _, length := range network.lengths {
+			if len(digits) == length {
+				return luhn(digits)
+			}
+		}
+	}
+
+	return false
+}
+
+// luhn reports whether digits pass the Luhn checksum used by card numbers.
+func luhn(digits []byte) bool {
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+
+	return sum%10 == 0
+}
+
+// Config holds the redaction rules. Fields are patterns matched against the names of the fields, and their
+// dotted paths for nested fields, ignoring case (i.e. "*password*", "authorization" or "user.email").
+type Config struct {
+	Fields    []string
+	Values    []string
+	Detectors []string
+	// Hash replaces the values with a keyed hash of their content instead of a mask, so that the same value
+	// is always redacted the same way and entries can still be correlated. It requires a key.
+	Hash    bool
+	HashKey string
+}
+
+// Redactor redacts lines. A nil Redactor leaves them unchanged.
+type Redactor struct {
+	fields    []string
+	detectors []Detector
+	hash      bool
+	key       []byte
+}
+
+// New returns a Redactor for the rules, or nil if there are none.
+func New(conf Config) (*Redactor, error) {
+	if conf.Hash && conf.HashKey == "" {
+		return nil, errHashKey
+	}
+	if len(conf.Fields) == 0 && len(conf.Values) == 0 && len(conf.Detectors) == 0 {
+		return nil, nil
+	}
+
+	r := &Redactor{
+		hash: conf.Hash,
+		key:  []byte(conf.HashKey),
+	}
+	for _, f := range conf.Fields {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if _, err := path.Match(f, ""); err != nil {
+			return nil, fmt.Errorf("invalid redacted field pattern %q: %v", f, err)
+		}
+		r.fields = append(r.fields, f)
+	}
+	for _, v := range conf.Values {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redacted value regexp %q: %v", v, err)
+		}
+		r.detectors = append(r.detectors, Detector{re: re})
+	}
+	for _, name := range conf.Detectors {
+		d, ok := Detectors[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction detector %q (expected one of %s)", name, strings.Join(detectorNames(), ", "))
+		}
+		r.detectors = append(r.detectors, d)
+	}
+
+	return r, nil
+}
+
+func detectorNames() []string {
+	names := make([]string, 0, len(Detectors))
+	for name := range Detectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Redact returns the line with the values redacted. JSON lines are walked through, nested objects included, and
+// only the redacted values are replaced, keeping the rest of the line as is. Only the value rules apply to other
+// lines. The value rules only apply to strings, not to numbers.
+func (r *Redactor) Redact(line []byte) []byte {
+	if r == nil {
+		return line
+	}
+
+	trimmed := bytes.TrimSpace(line)
+	if !bytes.HasPrefix(trimmed, []byte("{")) || !gjson.ValidBytes(trimmed) {
+		s, changed := r.redactString(string(line))
+		if !changed {
+			return line
+		}
+		return []byte(s)
+	}
+
+	s, changed := r.redactJSON(gjson.ParseBytes(trimmed), "")
+	if !changed {
+		return line
+	}
+
+	return []byte(s)
+}
+
+// redactJSON returns the raw value with the values of its fields redacted, prefix being the path of its fields.
+func (r *Redactor) redactJSON(value gjson.Result, prefix string) (string, bool) {
+	switch {
+	case value.Type == gjson.String:
+		s, changed := r.redactString(value.Str)
+		if !changed {
+			return value.Raw, false
+		}
+		return marshalString(s), true
+	case value.IsObject() || value.IsArray():
+	default:
+		return value.Raw, false
+	}
+
+	// the redacted values are spliced into the raw value, from the last one
+	type splice struct {
+		start, end int
+		raw        string
+	}
+	splices := []splice{}
+	value.ForEach(func(key, v gjson.Result) bool {
+		raw, changed := "", false
+		switch {
+		case !value.IsObject():
+			raw, changed = r.redactJSON(v, prefix)
+		case r.matchField(key.Str, prefix+key.Str):
+			raw, changed = r.replace(v), true
+		default:
+			raw, changed = r.redactJSON(v, prefix+key.Str+".")
+		}
+		if changed {
+			splices = append(splices, splice{v.Index, v.Index + len(v.Raw), raw})
+		}
+		return true
+	})
+	if len(splices) == 0 {
+		return value.Raw, false
+	}
+
+	s := value.Raw
+	for i := len(splices) - 1; i >= 0; i-- {
+		sp := splices[i]
+		s = s[:sp.start] + sp.raw + s[sp.end:]
+	}
+
+	return s, true
+}
+
+func (r *Redactor) matchField(name, fullPath string) bool {
+	name, fullPath = strings.ToLower(name), strings.ToLower(fullPath)
+	for _, pattern := range r.fields {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, fullPath); ok && fullPath != name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Redactor) redactString(s string) (string, bool) {
+	changed := false
+	for _, d := range r.detectors {
+		s = d.re.ReplaceAllStringFunc(s, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			changed = true
+			return r.token(match)
+		})
+	}
+
+	return s, changed
+}
+
+// replace returns the redacted form of the value of a field matching a field rule, as raw JSON.
+func (r *Redactor) replace(v gjson.Result) string {
+	if v.Type == gjson.String {
+		return marshalString(r.token(v.Str))
+	}
+
+	return marshalString(r.token(v.Raw))
+}
+
+func (r *Redactor) token(value string) string {
+	if !r.hash {
+		return mask
+	}
+
+	h := hmac.New(sha256.New, r.key)
+	_, _ = h.Write([]byte(value))
+
+	return hashPrefix + hex.EncodeToString(h.Sum(nil))[:hashLength] + hashSuffix
+}
+
+// marshalString returns s as a JSON string, without escaping the HTML characters.
+func marshalString(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+
+	return strings.TrimSuffix(b.String(), "\n")
+}